@@ -24,7 +24,7 @@ func main() {
 			Destination: &configFile,
 			Name:        "c, config",
 			Value:       "definition.json",
-			Usage:       "Path to configuration file",
+			Usage:       "Path to configuration file (.json, .yaml or .yml)",
 		},
 		cli.IntFlag{
 			Destination: &ConfigFuncPort,
@@ -32,13 +32,44 @@ func main() {
 			Value:       8080,
 			Usage:       "Port for functions to listen on",
 		},
+		cli.DurationFlag{
+			Destination: &Timeout,
+			Name:        "timeout",
+			Value:       Timeout,
+			Usage:       "Timeout for connectivity probes, function calls time out after 4x",
+		},
+		cli.BoolFlag{
+			Destination: &TLSEnabled,
+			Name:        "tls",
+			Usage:       "Serve and call functions over TLS",
+		},
+		cli.BoolFlag{
+			Destination: &MutualTLS,
+			Name:        "mtls",
+			Usage:       "Require client certificates on function calls, implies --tls",
+		},
+		cli.StringFlag{
+			Destination: &TLSDir,
+			Name:        "tls-dir",
+			Value:       "certs",
+			Usage:       "Directory holding the CA and host certificates",
+		},
 	}
 	app.Commands = []cli.Command{
 		NodeCommand,
 		StatusCommand,
+		ClusterCommand,
+		VerifyCommand,
+		LintCommand,
+		GraphCommand,
 		GenerateK8sSpecCommand,
 		GenerateK8sNetPolicyCommand,
+		GenerateK8sManifestsCommand,
 		L7PolicyGenerateCommand,
+		GenerateCiliumPolicyCommand,
+		GenerateIstioPolicyCommand,
+		GenerateComposeCommand,
+		GenerateCertsCommand,
 	}
 	app.Before = initEnv
 
@@ -50,5 +81,9 @@ func initEnv(ctx *cli.Context) error {
 		log.Fatal(err)
 	}
 
+	if MutualTLS {
+		TLSEnabled = true
+	}
+
 	return nil
 }
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+var (
+	ciliumPolicyFile string
+
+	GenerateCiliumPolicyCommand = cli.Command{
+		Name:     "generate-cilium-policy",
+		Usage:    "Generate CiliumNetworkPolicies with L7 HTTP rules",
+		Category: "L7 policy generation",
+		Action:   generateCiliumPolicy,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Destination: &ciliumPolicyFile,
+				Name:        "o, output",
+				Value:       "cilium-policy.yaml",
+				Usage:       "Path of the multi-document YAML bundle to write",
+			},
+			cli.StringFlag{
+				Destination: &manifestNamespace,
+				Name:        "n, namespace",
+				Usage:       "Namespace to place the policies in",
+			},
+		},
+	}
+)
+
+type ciliumPolicySpec struct {
+	EndpointSelector k8sSelector        `yaml:"endpointSelector"`
+	Ingress          []ciliumPolicyRule `yaml:"ingress"`
+}
+
+type ciliumPolicyRule struct {
+	FromEndpoints []k8sSelector  `yaml:"fromEndpoints"`
+	ToPorts       []ciliumToPort `yaml:"toPorts"`
+}
+
+type ciliumToPort struct {
+	Ports []ciliumPort   `yaml:"ports"`
+	Rules *ciliumL7Rules `yaml:"rules,omitempty"`
+}
+
+type ciliumPort struct {
+	Port     string `yaml:"port"`
+	Protocol string `yaml:"protocol"`
+}
+
+type ciliumL7Rules struct {
+	HTTP []ciliumHTTPRule `yaml:"http"`
+}
+
+type ciliumHTTPRule struct {
+	Method  string   `yaml:"method"`
+	Path    string   `yaml:"path"`
+	Headers []string `yaml:"headers,omitempty"`
+}
+
+// newCiliumHTTPRule returns the rule matching the requests sent to call hf.
+// Method and path are anchored regular expressions, the path includes the
+// query string as it is sent by callers.
+func newCiliumHTTPRule(hf FuncHttp) ciliumHTTPRule {
+	method, path := hf.WireRequest()
+	if IsRoutePattern(path) {
+		path = RouteRegex(path)
+	} else {
+		path = regexp.QuoteMeta(path)
+	}
+	if hf.query != "" {
+		path += regexp.QuoteMeta("?" + hf.query)
+	}
+
+	rule := ciliumHTTPRule{Method: method, Path: path}
+	for _, hdr := range strings.Fields(hf.headers) {
+		i := strings.Index(hdr, ":")
+		if hdr[i+1:] == "" {
+			rule.Headers = append(rule.Headers, hdr[:i])
+		} else {
+			rule.Headers = append(rule.Headers, hdr[:i]+": "+hdr[i+1:])
+		}
+	}
+
+	return rule
+}
+
+// ciliumIngress returns the ingress rules of host. Each port allows the
+// status service at L4 and every caller at L7, limited to the HTTP requests
+// of its calls. Calls to TCP and UDP sockets are allowed at L4 only.
+func ciliumIngress(host FuncHost, funcPort ExternalFuncPort) []ciliumPolicyRule {
+	var rules []ciliumPolicyRule
+
+	for _, port := range sortedPorts(funcPort) {
+		status := ciliumPolicyRule{FromEndpoints: []k8sSelector{*podSelector(statusIdentity)}}
+		for _, proto := range portProtocols(funcPort[port]) {
+			status.ToPorts = append(status.ToPorts, ciliumToPort{
+				Ports: []ciliumPort{{string(port), proto}},
+			})
+		}
+		rules = append(rules, status)
+
+		// calls made by each calling host to this port, by protocol
+		calls := make(map[FuncHost]map[string][]FuncHttp)
+		for _, caller := range FindCallers(host, port) {
+			for _, call := range definitionTree.Funcs[caller].AllHttp() {
+				if call.host != host || call.port != port {
+					continue
+				}
+				if _, ok := calls[caller.host]; !ok {
+					calls[caller.host] = make(map[string][]FuncHttp)
+				}
+				proto := call.Protocol()
+				calls[caller.host][proto] = append(calls[caller.host][proto], call)
+			}
+		}
+
+		callers := make([]string, 0, len(calls))
+		for caller := range calls {
+			callers = append(callers, string(caller))
+		}
+		sort.Strings(callers)
+
+		for _, caller := range callers {
+			rule := ciliumPolicyRule{FromEndpoints: []k8sSelector{*podSelector(caller)}}
+			for _, proto := range []string{FuncTypeTCP, FuncTypeUDP} {
+				protoCalls, ok := calls[FuncHost(caller)][proto]
+				if !ok {
+					continue
+				}
+				rule.ToPorts = append(rule.ToPorts, ciliumToPort{
+					Ports: []ciliumPort{{string(port), proto}},
+					Rules: ciliumL7(protoCalls),
+				})
+			}
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules
+}
+
+// ciliumL7 returns the HTTP rules for calls or nil if any of the calls is
+// a socket, which cannot be parsed as HTTP.
+func ciliumL7(calls []FuncHttp) *ciliumL7Rules {
+	seen := make(map[string]bool)
+	l7 := &ciliumL7Rules{}
+	for _, call := range calls {
+		if call.IsSocket() {
+			return nil
+		}
+
+		rule := newCiliumHTTPRule(call)
+		key := fmt.Sprintf("%+v", rule)
+		if !seen[key] {
+			seen[key] = true
+			l7.HTTP = append(l7.HTTP, rule)
+		}
+	}
+
+	sort.Slice(l7.HTTP, func(i, j int) bool {
+		a, b := l7.HTTP[i], l7.HTTP[j]
+		return a.Path < b.Path || (a.Path == b.Path && a.Method < b.Method)
+	})
+	return l7
+}
+
+func generateCiliumPolicy(cli *cli.Context) {
+	tree := GetExternalFuncTree()
+
+	hosts := sortedHosts(tree)
+
+	objects := []interface{}{}
+	for _, host := range hosts {
+		policy := newK8sObject("cilium.io/v2", "CiliumNetworkPolicy", "policy-"+host)
+		policy.Spec = &ciliumPolicySpec{
+			EndpointSelector: *podSelector(host),
+			Ingress:          ciliumIngress(FuncHost(host), tree[FuncHost(host)]),
+		}
+		objects = append(objects, policy)
+	}
+
+	writeManifests(ciliumPolicyFile, objects, "CiliumNetworkPolicies")
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mailgun/manners"
+	"github.com/urfave/cli"
+)
+
+var (
+	clusterAddr     string
+	clusterBasePort int
+
+	ClusterCommand = cli.Command{
+		Name:     "cluster",
+		Usage:    "Runs all function nodes and the status service in a single process",
+		Category: "Function simulation",
+		Action:   runCluster,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Destination: &clusterAddr,
+				Name:        "a, address",
+				Value:       "127.0.0.1",
+				Usage:       "Address to bind the function listeners to",
+			},
+			cli.IntFlag{
+				Destination: &clusterBasePort,
+				Name:        "base-port",
+				Usage:       "First port to assign to function listeners, random ports if 0",
+			},
+			cli.IntFlag{
+				Destination: &statusPort,
+				Value:       8888,
+				Name:        "p, port",
+				Usage:       "Port for status service to listen on",
+			},
+		},
+	}
+)
+
+// dialOverrides maps "network/host:port" of every function served by the
+// cluster to the address it is actually listening on. It is populated
+// before any function is served and read-only afterwards.
+var dialOverrides = make(map[string]string)
+
+func dialKey(network string, addr string) string {
+	return network + "/" + addr
+}
+
+// dialAddr returns the address to dial to reach addr over network
+func dialAddr(network string, addr string) string {
+	if override, ok := dialOverrides[dialKey(network, addr)]; ok {
+		return override
+	}
+	return addr
+}
+
+func dialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	var d net.Dialer
+	proto := network
+	if strings.HasPrefix(proto, "tcp") {
+		proto = "tcp"
+	}
+	return d.DialContext(ctx, network, dialAddr(proto, addr))
+}
+
+var httpTransport = newHttpTransport()
+
+func newHttpTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = dialContext
+	return t
+}
+
+// clusterListener is a listener serving the functions of host on port
+type clusterListener struct {
+	name     string
+	host     FuncHost
+	port     FuncPort
+	addr     string
+	listener net.Listener
+}
+
+// clusterAddress returns the address for the i-th listener of the cluster
+func clusterAddress(i int) string {
+	if clusterBasePort == 0 {
+		return net.JoinHostPort(clusterAddr, "0")
+	}
+	return net.JoinHostPort(clusterAddr, fmt.Sprint(clusterBasePort+i))
+}
+
+func runCluster(cli *cli.Context) {
+	tree := GetExternalFuncTree()
+
+	hosts := sortedHosts(tree)
+
+	var sockets []FuncHttp
+	for key := range definitionTree.Funcs {
+		if hf, ok := key.(FuncHttp); ok && hf.IsSocket() {
+			sockets = append(sockets, hf)
+		}
+	}
+	sort.Slice(sockets, func(i, j int) bool { return sockets[i].String() < sockets[j].String() })
+
+	var listeners []*clusterListener
+	for _, host := range hosts {
+		for _, port := range httpPorts(host) {
+			ln, err := net.Listen("tcp", clusterAddress(len(listeners)))
+			if err != nil {
+				log.Fatalf("Unable to listen for %s:%s: %s", host, port, err)
+			}
+
+			name := host + ":" + string(port)
+			listeners = append(listeners, &clusterListener{name, FuncHost(host), port, ln.Addr().String(), ln})
+			dialOverrides[dialKey("tcp", name)] = ln.Addr().String()
+		}
+	}
+
+	for _, hf := range sockets {
+		key := dialKey(strings.ToLower(hf.Protocol()), string(hf.host)+":"+string(hf.port))
+		if _, ok := dialOverrides[key]; ok {
+			log.Fatalf("%+v shares %s port %s with another function", hf, hf.Protocol(), hf.port)
+		}
+
+		addr, err := ServeSocket(hf, clusterAddress(len(listeners)))
+		if err != nil {
+			log.Fatalf("Unable to listen for %+v: %s", hf, err)
+		}
+
+		listeners = append(listeners, &clusterListener{hf.String(), hf.host, hf.port, addr, nil})
+		dialOverrides[key] = addr
+	}
+
+	for _, l := range listeners {
+		fmt.Printf("%-40s %s\n", l.name, l.addr)
+	}
+
+	servers := []*manners.GracefulServer{newStatusServer()}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := listenAndServe(servers[0], []string{statusIdentity}, false); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	for _, l := range listeners {
+		if l.listener == nil {
+			continue
+		}
+
+		s := newFuncServer("", string(l.host), l.port)
+		servers = append(servers, s)
+
+		wg.Add(1)
+		go func(s *manners.GracefulServer, l *clusterListener) {
+			defer wg.Done()
+			if err := serveListener(s, l.listener, []string{string(l.host)}, MutualTLS); err != nil {
+				log.Fatal(err)
+			}
+		}(s, l)
+	}
+
+	go func() {
+		sigchan := make(chan os.Signal, 1)
+		signal.Notify(sigchan, os.Interrupt, os.Kill)
+		<-sigchan
+		log.Info("Shutting down...")
+		for _, s := range servers {
+			s.Close()
+		}
+	}()
+
+	wg.Wait()
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/urfave/cli"
+)
+
+const (
+	composeConfigDir = "/etc/apisim"
+	composeCertsDir  = "/etc/apisim-certs"
+)
+
+var (
+	composeFile  string
+	composeImage string
+
+	GenerateComposeCommand = cli.Command{
+		Name:     "generate-compose",
+		Usage:    "Generate a Docker Compose file",
+		Category: "Docker Compose file generation",
+		Action:   generateCompose,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Destination: &composeFile,
+				Name:        "o, output",
+				Value:       "docker-compose.yml",
+				Usage:       "Path of the compose file to write",
+			},
+			cli.StringFlag{
+				Destination: &composeImage,
+				Name:        "image",
+				Value:       "tgraf/apisim:latest",
+				Usage:       "Image to run the function nodes from",
+			},
+			cli.IntFlag{
+				Destination: &statusPort,
+				Value:       8888,
+				Name:        "p, port",
+				Usage:       "Port to publish the status service on",
+			},
+		},
+	}
+)
+
+type ComposeService struct {
+	Name    string
+	Alias   string
+	Command string
+	Volumes []string
+	Expose  []string
+	Ports   []string
+}
+
+type ComposeTemplate struct {
+	Image    string
+	Volumes  []string
+	Services []ComposeService
+}
+
+// composePath returns p relative to the directory of the compose file, as
+// docker compose resolves relative volume paths against it.
+func composePath(p string) string {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		log.Fatalf("Unable to resolve \"%s\": %s", p, err)
+	}
+
+	dir, err := filepath.Abs(filepath.Dir(composeFile))
+	if err != nil {
+		log.Fatalf("Unable to resolve \"%s\": %s", composeFile, err)
+	}
+
+	rel, err := filepath.Rel(dir, abs)
+	if err != nil {
+		return abs
+	}
+
+	rel = filepath.ToSlash(rel)
+	if rel == "." || strings.HasPrefix(rel, "../") || rel == ".." {
+		return rel
+	}
+	return "./" + rel
+}
+
+// composeConfigVolumes returns the binds of the definition and the payload
+// files it references. The files are bound one by one to keep anything
+// else stored next to the definition, such as certificates, out of the
+// containers.
+func composeConfigVolumes() []string {
+	files, err := payloadFiles()
+	if err != nil {
+		log.Fatalf("Unable to include payload files: %s", err)
+	}
+
+	var volumes []string
+	for _, file := range append([]string{filepath.Base(configFile)}, files...) {
+		src := filepath.Join(definitionTree.BaseDir, filepath.FromSlash(file))
+		volumes = append(volumes, composePath(src)+":"+path.Join(composeConfigDir, file)+":ro")
+	}
+	return volumes
+}
+
+// composeCertVolumes returns the binds of the CA certificate and the key
+// pair of name, the only certificate files the service of name needs.
+func composeCertVolumes(name string) []string {
+	if !TLSEnabled {
+		return nil
+	}
+
+	caFile, _ := certPath(caName)
+	certFile, keyFile := certPath(name)
+
+	var volumes []string
+	for _, file := range []string{caFile, certFile, keyFile} {
+		volumes = append(volumes, composePath(file)+":"+path.Join(composeCertsDir, filepath.Base(file))+":ro")
+	}
+	return volumes
+}
+
+// composeCommand returns the command line running apisim with the global
+// options of the current invocation.
+func composeCommand(args ...string) string {
+	cmd := []string{"app",
+		"-c", path.Join(composeConfigDir, filepath.Base(configFile)),
+		"--func-port", fmt.Sprint(ConfigFuncPort),
+		"--timeout", Timeout.String(),
+	}
+
+	if MutualTLS {
+		cmd = append(cmd, "--mtls", "--tls-dir", composeCertsDir)
+	} else if TLSEnabled {
+		cmd = append(cmd, "--tls", "--tls-dir", composeCertsDir)
+	}
+
+	out, _ := json.Marshal(append(cmd, args...))
+	return string(out)
+}
+
+func generateCompose(cli *cli.Context) {
+	tree := GetExternalFuncTree()
+
+	tmpl, err := template.ParseFiles("templates/docker_compose.yml")
+	if err != nil {
+		log.Fatalf("Unable to read template file: %s", err)
+	}
+
+	c := ComposeTemplate{
+		Image:   composeImage,
+		Volumes: composeConfigVolumes(),
+	}
+
+	hosts := sortedHosts(tree)
+
+	for _, host := range hosts {
+		svc := ComposeService{
+			Name:    host,
+			Alias:   host,
+			Command: composeCommand("node-server", "-n", host),
+			Volumes: composeCertVolumes(host),
+		}
+
+		funcPort := tree[FuncHost(host)]
+		for _, port := range sortedPorts(funcPort) {
+			for _, proto := range portProtocols(funcPort[port]) {
+				if proto == FuncTypeUDP {
+					svc.Expose = append(svc.Expose, string(port)+"/udp")
+				} else {
+					svc.Expose = append(svc.Expose, string(port))
+				}
+			}
+		}
+
+		c.Services = append(c.Services, svc)
+	}
+
+	// status can reach all functions and is published on the host
+	c.Services = append(c.Services, ComposeService{
+		Name:    statusIdentity,
+		Alias:   statusIdentity,
+		Command: composeCommand("status-server", "-p", fmt.Sprint(statusPort)),
+		Volumes: composeCertVolumes(statusIdentity),
+		Ports:   []string{fmt.Sprintf("%d:%d", statusPort, statusPort)},
+	})
+
+	log.Infof("Generating Docker Compose file %s...", composeFile)
+	out, err := os.Create(composeFile)
+	if err != nil {
+		log.Fatalf("Unable to open compose file \"%s\" for writing: %s", composeFile, err)
+	}
+
+	defer out.Close()
+
+	if err := tmpl.Execute(out, c); err != nil {
+		log.Fatalf("Unable to write compose file: %s", err)
+	}
+}
@@ -7,7 +7,11 @@ import (
 	"io/ioutil"
 	"net/http"
 	"path"
+	"path/filepath"
+	"sort"
 	"strings"
+
+	"gopkg.in/yaml.v3"
 )
 
 var (
@@ -17,55 +21,147 @@ var (
 type FuncHost string
 type FuncPort string
 type FuncNode struct {
-	method string
-	path   string
+	method  string
+	path    string
+	query   string
+	headers string
 }
 type FuncDef interface {
 	IsReference() bool
-	Handle(req *http.Request) string
+	Handle(req *http.Request) *CallResult
 	String() string
 }
 
 type FuncCalls []FuncDef
 
 type FuncTree struct {
-	Funcs map[FuncDef]FuncCalls
+	// BaseDir is the directory relative file names are resolved against
+	BaseDir string
+
+	Funcs   map[FuncDef]FuncCalls
+	Latency map[FuncDef]*Latency
+	Faults  map[FuncDef]FuncFaults
+	Attrs   map[FuncDef]*FuncAttrs
 }
 
 func NewFuncTree() *FuncTree {
 	return &FuncTree{
-		Funcs: make(map[FuncDef]FuncCalls),
+		Funcs:   make(map[FuncDef]FuncCalls),
+		Latency: make(map[FuncDef]*Latency),
+		Faults:  make(map[FuncDef]FuncFaults),
+		Attrs:   make(map[FuncDef]*FuncAttrs),
 	}
 }
 
-func ParseFuncType(name string, data string) (FuncDef, error) {
+// ParseFuncType returns the function of type name. HTTP functions accept
+// header constraints as extra arguments, GRPC, PUBLISH and SUBSCRIBE
+// functions take the host as first extra argument, the data of DATA
+// functions spans all arguments.
+func ParseFuncType(name string, data string, extra []string) (FuncDef, error) {
 	switch name {
-	case "GET":
-		return NewFuncHttp("GET", data)
-	case "POST":
-		return NewFuncHttp("POST", data)
-	case "PUT":
-		return NewFuncHttp("PUT", data)
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions, http.MethodTrace:
+		return NewFuncHttp(name, data, extra...)
+	case FuncTypeGrpc:
+		if len(extra) == 0 {
+			return nil, fmt.Errorf("missing host of GRPC %s", data)
+		}
+		return NewFuncGrpc(data, extra[0], extra[1:]...)
+	case FuncTypePublish, FuncTypeSubscribe:
+		if len(extra) != 1 {
+			return nil, fmt.Errorf("expected \"%s topic host\", got %s %s %v", name, name, data, extra)
+		}
+		return NewFuncTopic(name, data, extra[0])
+	case FuncTypeTCP, FuncTypeUDP:
+		if len(extra) > 0 {
+			return nil, fmt.Errorf("unexpected arguments %v to %s %s", extra, name, data)
+		}
+		return NewFuncSocket(name, data)
 	case "CALL":
+		if len(extra) > 0 {
+			return nil, fmt.Errorf("unexpected arguments %v to CALL %s", extra, data)
+		}
 		return NewFuncCall(data), nil
 	case "DATA":
-		return NewFuncData(data), nil
+		return NewFuncData(strings.Join(append([]string{data}, extra...), " ")), nil
 	default:
 		return nil, fmt.Errorf("unknown type \"%s\"", name)
 	}
 }
 
-func LookupFuncDef(name string) (FuncDef, FuncCalls, error) {
+// LookupFuncDef returns the function matching name and, if given, the
+// query parameters and headers of req. Functions defined with the exact
+// path take precedence over route patterns, of which the most specific one
+// is chosen. Ties are broken in favour of the function with the most query
+// and header constraints. The values captured by a route pattern are
+// returned along with the function.
+func LookupFuncDef(name string, req *http.Request) (FuncDef, FuncCalls, RouteParams, error) {
 	def, err := ParseFuncDef(name)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
+	}
+
+	hf, ok := def.(FuncHttp)
+	if !ok {
+		if calls, ok := definitionTree.Funcs[def]; ok {
+			return def, calls, nil, nil
+		}
+		return nil, nil, nil, nil
+	}
+
+	var (
+		best       FuncDef
+		bestParams RouteParams
+		bestRank   [4]int
+	)
+
+	for key := range definitionTree.Funcs {
+		pf, ok := key.(FuncHttp)
+		if !ok || pf.method != hf.method || pf.host != hf.host || pf.port != hf.port {
+			continue
+		}
+
+		var rank [4]int
+		var params RouteParams
+
+		if pf.path == hf.path {
+			rank[0] = 1
+		} else if IsRoutePattern(pf.path) {
+			if params, ok = matchRoute(pf.path, hf.path); !ok {
+				continue
+			}
+			rank[1], rank[2] = routeSpecificity(pf.path)
+		} else {
+			continue
+		}
+
+		if req != nil && !pf.MatchRequest(req) {
+			continue
+		} else if req == nil && pf.Constraints() > 0 {
+			continue
+		}
+		rank[3] = pf.Constraints()
+
+		if best == nil || rankLess(bestRank, rank) ||
+			(rank == bestRank && key.String() < best.String()) {
+			best, bestParams, bestRank = key, params, rank
+		}
 	}
 
-	if calls, ok := definitionTree.Funcs[def]; ok {
-		return def, calls, nil
+	if best == nil {
+		return nil, nil, nil, nil
 	}
 
-	return nil, nil, nil
+	return best, definitionTree.Funcs[best], bestParams, nil
+}
+
+func rankLess(a, b [4]int) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
 }
 
 func IsCaller(caller FuncDef, callee FuncDef) bool {
@@ -99,15 +195,11 @@ func FindCallers(host FuncHost, port FuncPort) HttpCallers {
 		case FuncHttp:
 			httpFunc := key.(FuncHttp)
 
-			for _, call := range definitionTree.Funcs[key] {
-				switch call.(type) {
-				case FuncHttp:
-					httpCall := call.(FuncHttp)
-
-					if httpCall.host == host &&
-						httpCall.port == port {
-						result = append(result, httpFunc)
-					}
+			for _, httpCall := range definitionTree.Funcs[key].AllHttp() {
+				if httpCall.host == host &&
+					httpCall.port == port {
+					result = append(result, httpFunc)
+					break
 				}
 			}
 		}
@@ -136,7 +228,7 @@ func GetExternalFuncTree() ExternalFuncTree {
 				result[hf.host][hf.port] = make(ExternalFuncNode)
 			}
 
-			node := FuncNode{hf.method, hf.path}
+			node := FuncNode{hf.method, hf.path, hf.query, hf.headers}
 			result[hf.host][hf.port][node] = calls
 		}
 	}
@@ -144,6 +236,42 @@ func GetExternalFuncTree() ExternalFuncTree {
 	return result
 }
 
+// sortedHosts returns the hosts of tree in alphabetical order
+func sortedHosts(tree ExternalFuncTree) []string {
+	hosts := make([]string, 0, len(tree))
+	for host := range tree {
+		hosts = append(hosts, string(host))
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// GetHostAttrs merges the deployment attributes of all functions served by
+// host. The largest number of replicas requested by any function wins.
+func GetHostAttrs(host FuncHost) *FuncAttrs {
+	result := &FuncAttrs{
+		Replicas: 1,
+		Labels:   make(map[string]string),
+	}
+
+	for key, attrs := range definitionTree.Attrs {
+		hf, ok := key.(FuncHttp)
+		if !ok || hf.host != host {
+			continue
+		}
+
+		if attrs.Replicas > result.Replicas {
+			result.Replicas = attrs.Replicas
+		}
+
+		for k, v := range attrs.Labels {
+			result.Labels[k] = v
+		}
+	}
+
+	return result
+}
+
 type HttpCalls map[FuncHost]map[string]FuncHttp
 
 func GetUniqueHttpCalls() HttpCalls {
@@ -158,13 +286,8 @@ func GetUniqueHttpCalls() HttpCalls {
 				result[hf.host] = make(map[string]FuncHttp)
 			}
 
-			for _, call := range definitionTree.Funcs[key] {
-				switch call.(type) {
-				case FuncHttp:
-					c := call.(FuncHttp)
-					cKey := fmt.Sprintf("%s %s", c.method, c.uri)
-					result[hf.host][cKey] = c
-				}
+			for _, c := range definitionTree.Funcs[key].AllHttp() {
+				result[hf.host][c.String()] = c
 			}
 		}
 	}
@@ -199,6 +322,32 @@ func (c FuncCalls) Http() map[FuncDef]FuncHttp {
 	return res
 }
 
+// AllHttp returns the HTTP calls made directly and those made through the
+// CALL functions referenced, transitively. CALL functions run in the
+// process of the caller, so all of them originate from the calling host.
+func (c FuncCalls) AllHttp() map[FuncDef]FuncHttp {
+	res := make(map[FuncDef]FuncHttp)
+	seen := make(map[FuncDef]bool)
+
+	var walk func(calls FuncCalls)
+	walk = func(calls FuncCalls) {
+		for _, call := range calls {
+			switch call.(type) {
+			case FuncHttp:
+				res[call] = call.(FuncHttp)
+			case FuncCall:
+				if !seen[call] {
+					seen[call] = true
+					walk(definitionTree.Funcs[call])
+				}
+			}
+		}
+	}
+	walk(c)
+
+	return res
+}
+
 func GetHttpFuncs(req *http.Request) map[FuncDef]FuncHttp {
 	result := make(map[FuncDef]FuncHttp)
 
@@ -218,12 +367,12 @@ func GetHttpFuncs(req *http.Request) map[FuncDef]FuncHttp {
 }
 
 func ParseFuncDef(key string) (FuncDef, error) {
-	var t, data string
-	if n, err := fmt.Sscanf(key, "%s %s", &t, &data); n != 2 || err != nil {
-		return nil, fmt.Errorf("invalid key \"%s\": %s", key, err.Error())
+	fields := strings.Fields(key)
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("invalid key \"%s\": expected \"TYPE DATA\"", key)
 	}
 
-	ft, err := ParseFuncType(t, data)
+	ft, err := ParseFuncType(fields[0], fields[1], fields[2:])
 	if err != nil {
 		return nil, err
 	}
@@ -231,16 +380,104 @@ func ParseFuncDef(key string) (FuncDef, error) {
 	return ft, nil
 }
 
-type FuncCallsJSON []string
+type FuncCallsJSON []FuncCallSpec
+
+// FuncSpec is the definition of a single function. It is either given as
+// a plain list of calls or as an object which carries additional
+// attributes of the function.
+type FuncSpec struct {
+	Calls     FuncCallsJSON     `json:"Calls" yaml:"Calls"`
+	Body      json.RawMessage   `json:"Body,omitempty" yaml:"-"`
+	Payload   *Payload          `json:"Payload,omitempty" yaml:"Payload"`
+	Status    int               `json:"Status,omitempty" yaml:"Status"`
+	Headers   map[string]string `json:"Headers,omitempty" yaml:"Headers"`
+	Request   *RequestExpect    `json:"Request,omitempty" yaml:"Request"`
+	Latency   *Latency          `json:"Latency,omitempty" yaml:"Latency"`
+	Faults    FuncFaults        `json:"Faults,omitempty" yaml:"Faults"`
+	Replicas  int               `json:"Replicas,omitempty" yaml:"Replicas"`
+	Labels    map[string]string `json:"Labels,omitempty" yaml:"Labels"`
+	Handshake *Handshake        `json:"Handshake,omitempty" yaml:"Handshake"`
+}
+
+func (s *FuncSpec) UnmarshalJSON(data []byte) error {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		return json.Unmarshal(data, &s.Calls)
+	}
+
+	type plain FuncSpec
+	return json.Unmarshal(data, (*plain)(s))
+}
+
+// FuncAttrs are the attributes of a function beyond its calls
+type FuncAttrs struct {
+	Payload   *Payload
+	Status    int
+	Headers   map[string]string
+	Request   *RequestExpect
+	Replicas  int
+	Labels    map[string]string
+	Handshake *Handshake
+}
+
+func (a *FuncAttrs) validate() error {
+	if a.Status != 0 && (a.Status < 100 || a.Status > 599) {
+		return fmt.Errorf("invalid status code %d", a.Status)
+	}
+
+	if a.Replicas < 0 {
+		return fmt.Errorf("invalid number of replicas %d", a.Replicas)
+	}
+
+	if _, ok := a.Labels[manifestLabel]; ok {
+		return fmt.Errorf("label \"%s\" is reserved for selecting the pods of a function", manifestLabel)
+	}
+
+	if a.Request != nil {
+		return a.Request.validate()
+	}
+
+	return nil
+}
+
+// RequestExpect returns the expectations on request bodies, if any
+func (a *FuncAttrs) RequestExpect() *RequestExpect {
+	if a == nil {
+		return nil
+	}
+	return a.Request
+}
+
+// SocketHandshake returns the handshake of a socket function, if any
+func (a *FuncAttrs) SocketHandshake() *Handshake {
+	if a == nil {
+		return nil
+	}
+	return a.Handshake
+}
+
+// StatusCode returns the HTTP status code the function answers with
+func (a *FuncAttrs) StatusCode() int {
+	if a == nil || a.Status == 0 {
+		return http.StatusOK
+	}
+	return a.Status
+}
+
+// funcTreeSpec is the on-disk representation of a FuncTree, shared by the
+// JSON and YAML definition formats.
+type funcTreeSpec struct {
+	Funcs   map[string]*FuncSpec  `json:"Functions" yaml:"Functions"`
+	Latency map[string]*Latency   `json:"Latency" yaml:"Latency"`
+	Faults  map[string]FuncFaults `json:"Faults" yaml:"Faults"`
+}
 
 func (f *FuncTree) UnmarshalJSON(data []byte) error {
 	if len(data) == 0 {
 		return fmt.Errorf("empty function tree")
 	}
 
-	var pt struct {
-		Funcs map[string]FuncCallsJSON `json:"Functions"`
-	}
+	var pt funcTreeSpec
 
 	decoder := json.NewDecoder(bytes.NewReader(data))
 	err := decoder.Decode(&pt)
@@ -248,31 +485,163 @@ func (f *FuncTree) UnmarshalJSON(data []byte) error {
 		return fmt.Errorf("invalid json: %s", err)
 	}
 
-	for key, _ := range pt.Funcs {
+	return f.load(&pt)
+}
+
+func (f *FuncTree) setLatency(key string, def FuncDef, latency *Latency) error {
+	if latency == nil {
+		return nil
+	}
+
+	if _, ok := f.Latency[def]; ok {
+		return fmt.Errorf("latency for \"%s\" defined twice", key)
+	}
+
+	if err := latency.Validate(); err != nil {
+		return fmt.Errorf("invalid latency for \"%s\": %s", key, err)
+	}
+
+	f.Latency[def] = latency
+	return nil
+}
+
+func (f *FuncTree) setFaults(key string, def FuncDef, faults FuncFaults) error {
+	if len(faults) == 0 {
+		return nil
+	}
+
+	if _, ok := f.Faults[def]; ok {
+		return fmt.Errorf("faults for \"%s\" defined twice", key)
+	}
+
+	if err := faults.Validate(); err != nil {
+		return fmt.Errorf("invalid faults for \"%s\": %s", key, err)
+	}
+
+	f.Faults[def] = faults
+	return nil
+}
+
+func (f *FuncTree) load(pt *funcTreeSpec) error {
+	for key, spec := range pt.Funcs {
 		def, err := ParseFuncDef(key)
 		if err != nil {
 			return err
 		}
 
-		calls := pt.Funcs[key]
-		f.Funcs[def] = make(FuncCalls, len(calls))
-		for i, call := range calls {
-			callDef, err := ParseFuncDef(call)
+		if hf, ok := def.(FuncHttp); ok {
+			if err := ValidateRoute(hf.path); err != nil {
+				return err
+			}
+			if hf.host == caName || hf.host == statusIdentity {
+				return fmt.Errorf("invalid function \"%s\": host name \"%s\" is reserved", key, hf.host)
+			}
+		}
+
+		if spec == nil {
+			spec = &FuncSpec{}
+		}
+
+		f.Funcs[def] = make(FuncCalls, len(spec.Calls))
+		for i, call := range spec.Calls {
+			callDef, err := ParseFuncDef(call.Call)
 			if err != nil {
 				return err
 			}
 
 			if callDef.IsReference() {
-				if _, ok := pt.Funcs[call]; !ok {
-					return fmt.Errorf("unable to find key \"%v\"", call)
+				if _, ok := pt.Funcs[call.Call]; !ok {
+					return fmt.Errorf("unable to find key \"%v\"", call.Call)
+				}
+			}
+
+			body, err := call.requestBody(f.BaseDir)
+			if err != nil {
+				return fmt.Errorf("invalid call \"%s\" of \"%s\": %s", call.Call, key, err)
+			} else if body != nil {
+				hf, ok := callDef.(FuncHttp)
+				if !ok || hf.IsSocket() {
+					return fmt.Errorf("call \"%s\" of \"%s\" cannot carry a body", call.Call, key)
 				}
+				hf.body = body
+				callDef = hf
 			}
 
 			f.Funcs[def][i] = callDef
 		}
+
+		payload := spec.Payload
+		if len(spec.Body) > 0 {
+			if payload != nil {
+				return fmt.Errorf("function \"%s\" has both Body and Payload", key)
+			}
+			payload = &Payload{Inline: spec.Body}
+		}
+
+		if payload != nil {
+			if err := payload.compile(f.BaseDir); err != nil {
+				return fmt.Errorf("invalid payload for \"%s\": %s", key, err)
+			}
+		}
+
+		attrs := &FuncAttrs{
+			Payload:   payload,
+			Status:    spec.Status,
+			Headers:   spec.Headers,
+			Request:   spec.Request,
+			Replicas:  spec.Replicas,
+			Labels:    spec.Labels,
+			Handshake: spec.Handshake,
+		}
+		if err := attrs.validate(); err != nil {
+			return fmt.Errorf("invalid function \"%s\": %s", key, err)
+		}
+
+		if err := validateSocketFunc(def, attrs, f.Funcs[def]); err != nil {
+			return fmt.Errorf("invalid function \"%s\": %s", key, err)
+		}
+		f.Attrs[def] = attrs
+
+		if err := f.setLatency(key, def, spec.Latency); err != nil {
+			return err
+		}
+
+		if err := f.setFaults(key, def, spec.Faults); err != nil {
+			return err
+		}
 	}
 
-	return nil
+	for key, latency := range pt.Latency {
+		if _, ok := pt.Funcs[key]; !ok {
+			return fmt.Errorf("latency defined for unknown function \"%s\"", key)
+		}
+
+		def, err := ParseFuncDef(key)
+		if err != nil {
+			return err
+		}
+
+		if err := f.setLatency(key, def, latency); err != nil {
+			return err
+		}
+	}
+
+	for key, faults := range pt.Faults {
+		if _, ok := pt.Funcs[key]; !ok {
+			return fmt.Errorf("faults defined for unknown function \"%s\"", key)
+		}
+
+		def, err := ParseFuncDef(key)
+		if err != nil {
+			return err
+		}
+
+		if err := f.setFaults(key, def, faults); err != nil {
+			return err
+		}
+	}
+
+	return f.linkTopics()
 }
 
 func getContext(content []byte, offset int64) (int, string, int) {
@@ -337,8 +706,21 @@ func ReadConfig(path string) error {
 		return err
 	}
 
-	if err := json.Unmarshal(content, definitionTree); err != nil {
-		return handleUnmarshalError(path, content, err)
+	definitionTree.BaseDir = filepath.Dir(path)
+
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		if len(bytes.TrimSpace(content)) == 0 {
+			return fmt.Errorf("Error: %s: empty yaml definition", filepath.Base(path))
+		}
+
+		if err := yaml.Unmarshal(content, definitionTree); err != nil {
+			return handleYAMLError(path, content, err)
+		}
+	default:
+		if err := json.Unmarshal(content, definitionTree); err != nil {
+			return handleUnmarshalError(path, content, err)
+		}
 	}
 
 	return nil
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var yamlErrorRe = regexp.MustCompile(`^(?:yaml: )?line (\d+): (?:column (\d+): )?(.*)$`)
+
+func (f *FuncTree) UnmarshalYAML(value *yaml.Node) error {
+	var pt funcTreeSpec
+
+	if err := value.Decode(&pt); err != nil {
+		return err
+	}
+
+	return f.load(&pt)
+}
+
+func (s *FuncSpec) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.SequenceNode {
+		return value.Decode(&s.Calls)
+	}
+
+	type plain FuncSpec
+	var spec struct {
+		plain `yaml:",inline"`
+		Body  yaml.Node `yaml:"Body"`
+	}
+
+	if err := value.Decode(&spec); err != nil {
+		return err
+	}
+
+	*s = FuncSpec(spec.plain)
+	if spec.Body.Kind != 0 {
+		body, err := yamlToJSON(&spec.Body)
+		if err != nil {
+			return err
+		}
+		s.Body = body
+	}
+
+	return nil
+}
+
+func (s *FuncCallSpec) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&s.Call)
+	}
+
+	type plain FuncCallSpec
+	var spec struct {
+		plain `yaml:",inline"`
+		Body  yaml.Node `yaml:"Body"`
+	}
+
+	if err := value.Decode(&spec); err != nil {
+		return err
+	}
+
+	*s = FuncCallSpec(spec.plain)
+	if spec.Body.Kind != 0 {
+		body, err := yamlToJSON(&spec.Body)
+		if err != nil {
+			return err
+		}
+		s.Body = body
+	}
+
+	return nil
+}
+
+func (p *Payload) UnmarshalYAML(value *yaml.Node) error {
+	type plain Payload
+	var payload struct {
+		plain  `yaml:",inline"`
+		Inline yaml.Node `yaml:"Inline"`
+	}
+
+	if err := value.Decode(&payload); err != nil {
+		return err
+	}
+
+	*p = Payload(payload.plain)
+	if payload.Inline.Kind != 0 {
+		inline, err := yamlToJSON(&payload.Inline)
+		if err != nil {
+			return err
+		}
+		p.Inline = inline
+	}
+
+	return nil
+}
+
+// yamlToJSON converts the YAML value of the node to its JSON representation
+func yamlToJSON(value *yaml.Node) (json.RawMessage, error) {
+	var v interface{}
+	if err := value.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, yamlNodeError(value, "value cannot be represented as JSON: %s", err)
+	}
+
+	return data, nil
+}
+
+// yamlNodeError returns an error pointing to the position of the node. It
+// is reported by the decoder along with its own type errors.
+func yamlNodeError(value *yaml.Node, format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	return &yaml.TypeError{
+		Errors: []string{fmt.Sprintf("line %d: column %d: %s", value.Line, value.Column, msg)},
+	}
+}
+
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	var s string
+	if value.Kind != yaml.ScalarNode || value.Decode(&s) != nil {
+		return yamlNodeError(value, "duration must be a string such as \"10ms\"")
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return yamlNodeError(value, "%s", err)
+	}
+
+	*d = Duration(v)
+	return nil
+}
+
+func getLineContext(content []byte, line int) (string, bool) {
+	lines := strings.Split(string(content), "\n")
+	if line < 1 || line > len(lines) {
+		return "", false
+	}
+
+	return strings.TrimRight(lines[line-1], "\r"), true
+}
+
+func formatYAMLError(f string, content []byte, msg string) string {
+	m := yamlErrorRe.FindStringSubmatch(msg)
+	if m == nil {
+		return fmt.Sprintf("Error: %s: %s", path.Base(f), strings.TrimPrefix(msg, "yaml: "))
+	}
+
+	line, _ := strconv.Atoi(m[1])
+	ctx, ok := getLineContext(content, line)
+	if !ok {
+		return fmt.Sprintf("Error: %s:%d: %s", path.Base(f), line, m[3])
+	}
+
+	if m[2] == "" {
+		return fmt.Sprintf("Error: %s:%d: %s:\n%s", path.Base(f), line, m[3], ctx)
+	}
+
+	column, _ := strconv.Atoi(m[2])
+	pre := []byte(ctx)
+	if column-1 < len(pre) {
+		pre = pre[:column-1]
+	}
+	for i := range pre {
+		if pre[i] != '\t' {
+			pre[i] = ' '
+		}
+	}
+
+	return fmt.Sprintf("Error: %s:%d: %s at column %d:\n%s\n%s^",
+		path.Base(f), line, m[3], column, ctx, pre)
+}
+
+func handleYAMLError(f string, content []byte, err error) error {
+	switch e := err.(type) {
+	case *yaml.TypeError:
+		msgs := make([]string, len(e.Errors))
+		for i, msg := range e.Errors {
+			msgs[i] = formatYAMLError(f, content, msg)
+		}
+		return fmt.Errorf("%s", strings.Join(msgs, "\n"))
+	default:
+		return fmt.Errorf("%s", formatYAMLError(f, content, err.Error()))
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+)
+
+const (
+	FaultStatus   = "status"
+	FaultDrop     = "drop"
+	FaultTruncate = "truncate"
+	FaultHang     = "hang"
+)
+
+// Fault describes a failure mode of a function which is injected into Rate
+// percent of all requests. Code is the HTTP status code returned by faults
+// of type "status".
+type Fault struct {
+	Type string  `json:"Type" yaml:"Type"`
+	Rate float64 `json:"Rate" yaml:"Rate"`
+	Code int     `json:"Code,omitempty" yaml:"Code,omitempty"`
+}
+
+func (f *Fault) Validate() error {
+	switch f.Type {
+	case FaultStatus:
+		if f.Code < 400 || f.Code > 599 {
+			return fmt.Errorf("status fault requires a 4xx or 5xx Code")
+		}
+	case FaultDrop, FaultTruncate, FaultHang:
+	default:
+		return fmt.Errorf("unknown fault type \"%s\"", f.Type)
+	}
+
+	if f.Rate < 0 || f.Rate > 100 {
+		return fmt.Errorf("fault rate %v is not a percentage", f.Rate)
+	}
+
+	return nil
+}
+
+func (f *Fault) String() string {
+	if f.Type == FaultStatus {
+		return fmt.Sprintf("%s %d", f.Type, f.Code)
+	}
+	return f.Type
+}
+
+type FuncFaults []*Fault
+
+func (faults FuncFaults) Validate() error {
+	total := 0.0
+	for _, f := range faults {
+		if err := f.Validate(); err != nil {
+			return err
+		}
+		total += f.Rate
+	}
+
+	if total > 100 {
+		return fmt.Errorf("fault rates add up to more than 100%%")
+	}
+
+	return nil
+}
+
+// Pick rolls the dice and returns the fault to inject into the current
+// request or nil if the request should succeed.
+func (faults FuncFaults) Pick() *Fault {
+	if len(faults) == 0 {
+		return nil
+	}
+
+	roll := rand.Float64() * 100
+	for _, f := range faults {
+		if roll < f.Rate {
+			return f
+		}
+		roll -= f.Rate
+	}
+
+	return nil
+}
+
+// abortConnection closes the connection of the request without writing any
+// further data.
+func abortConnection() {
+	panic(http.ErrAbortHandler)
+}
+
+// InjectFault handles the request according to the fault type. It returns
+// false if the request should be processed as usual and the response
+// passed to WriteResponse.
+func InjectFault(w http.ResponseWriter, req *http.Request, def FuncDef, fault *Fault) bool {
+	if fault == nil {
+		return false
+	}
+
+	log.Infof("Injecting fault \"%s\" into %s %s", fault, req.Method, req.URL)
+
+	switch fault.Type {
+	case FaultStatus:
+		err := fmt.Errorf("Injected fault: %d %s", fault.Code, http.StatusText(fault.Code))
+		WriteResponse(w, req, fault.Code, NewErrorResult(def.String(), err).JSON(), nil)
+		return true
+	case FaultDrop:
+		abortConnection()
+	case FaultHang:
+		<-req.Context().Done()
+		return true
+	}
+
+	return false
+}
+
+// WriteResponse writes the JSON response body, cutting it short and closing
+// the connection if the fault asks for a truncated body.
+func WriteResponse(w http.ResponseWriter, req *http.Request, status int, body string, fault *Fault) {
+	if IsGrpcRequest(req) {
+		WriteGrpcResponse(w, status, body, fault)
+		return
+	}
+
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+
+	if fault == nil || fault.Type != FaultTruncate {
+		fmt.Fprint(w, body)
+		return
+	}
+
+	fmt.Fprint(w, body[:len(body)/2])
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	abortConnection()
+}
@@ -1,12 +1,12 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
 	"net/url"
+	"sort"
 	"strings"
 	"sync"
 )
@@ -15,25 +15,6 @@ var (
 	FuncStackHeader = http.CanonicalHeaderKey("FuncStack")
 )
 
-func JSON(text string) string {
-	s, _ := json.Marshal(text)
-	return string(s)
-}
-
-func PrettyJSON(body string) string {
-	var prettyJSON bytes.Buffer
-	err := json.Indent(&prettyJSON, []byte(body), "", "\t")
-	if err != nil {
-		return JSON(fmt.Sprintf("JSON parse error: %s", err))
-	} else {
-		return string(prettyJSON.Bytes())
-	}
-}
-
-func ErrorReport(err error) string {
-	return JSON("ERROR: " + err.Error())
-}
-
 type FuncData struct {
 	data string
 }
@@ -44,8 +25,10 @@ func NewFuncData(data string) FuncData {
 
 func (f FuncData) IsReference() bool { return false }
 func (f FuncData) String() string    { return "DATA " + f.data }
-func (f FuncData) Handle(req *http.Request) string {
-	return fmt.Sprintf("{\"DATA\": %s}", JSON(f.data))
+func (f FuncData) Handle(req *http.Request) *CallResult {
+	result := NewCallResult(f.String())
+	result.Data, _ = json.Marshal(f.data)
+	return result
 }
 
 type FuncCall struct {
@@ -56,30 +39,27 @@ func NewFuncCall(name string) FuncCall {
 	return FuncCall{name: name}
 }
 
-func (c FuncCalls) Handle(req *http.Request) string {
-	reply := FuncMux(c.Http(), req, FuncHttp{}, HttpRequest)
+func (c FuncCalls) Handle(req *http.Request) []*CallResult {
+	results := FuncMux(c.Http(), req, FuncHttp{}, HttpRequest)
 
-	for k := range c.NonHttp() {
-		if reply != "" {
-			reply += ","
-		}
-		reply += c[k].Handle(req)
+	for _, call := range c.NonHttp() {
+		results = append(results, call.Handle(req))
 	}
 
-	return reply
+	return results
 }
 
 func (f FuncCall) IsReference() bool { return true }
 func (f FuncCall) String() string    { return "CALL " + f.name }
-func (f FuncCall) Handle(req *http.Request) string {
-	key := JSON(fmt.Sprintf("CALL %s", f.name))
-
+func (f FuncCall) Handle(req *http.Request) *CallResult {
 	calls, ok := definitionTree.Funcs[f]
 	if !ok {
-		return fmt.Sprintf("{%s: [\"Function not found\"]}", key)
+		return NewErrorResult(f.String(), fmt.Errorf("Function not found"))
 	}
 
-	return fmt.Sprintf("{%s: [%s]}", key, calls.Handle(req))
+	result := NewCallResult(f.String())
+	result.Children = calls.Handle(req)
+	return result
 }
 
 type FuncHttp struct {
@@ -88,9 +68,21 @@ type FuncHttp struct {
 	host   FuncHost
 	port   FuncPort
 	path   string
+
+	// query and headers are the canonical forms of the query parameters
+	// and request headers a request must carry to match the function
+	query   string
+	headers string
+
+	// body is only set on calls which send a request body
+	body *RequestBody
 }
 
-func NewFuncHttp(method string, uri string) (FuncHttp, error) {
+// NewFuncHttp returns the function served at uri. The uri may contain a
+// query string, each parameter of which must be present in matching
+// requests. A parameter without value matches any value. Each header
+// constraint has the form "Name:Value", an empty value matches any value.
+func NewFuncHttp(method string, uri string, headers ...string) (FuncHttp, error) {
 	url, err := url.Parse("http://" + uri)
 	if err != nil {
 		return FuncHttp{}, err
@@ -98,7 +90,6 @@ func NewFuncHttp(method string, uri string) (FuncHttp, error) {
 
 	if !strings.Contains(url.Host, ":") {
 		url.Host = url.Host + fmt.Sprintf(":%d", ConfigFuncPort)
-		uri = url.Host + url.Path
 	}
 
 	host, port, err := net.SplitHostPort(url.Host)
@@ -106,18 +97,127 @@ func NewFuncHttp(method string, uri string) (FuncHttp, error) {
 		return FuncHttp{}, fmt.Errorf("Unable derive host and port from \"%s\"", url.Host)
 	}
 
+	hdrs, err := canonicalHeaders(headers)
+	if err != nil {
+		return FuncHttp{}, err
+	}
+
 	return FuncHttp{
-		method: method,
-		uri:    uri,
-		host:   FuncHost(host),
-		port:   FuncPort(port),
-		path:   url.Path,
+		method:  method,
+		uri:     url.Host + url.Path,
+		host:    FuncHost(host),
+		port:    FuncPort(port),
+		path:    url.Path,
+		query:   canonicalQuery(url.RawQuery),
+		headers: hdrs,
 	}, nil
 }
 
+func canonicalQuery(rawQuery string) string {
+	params := strings.FieldsFunc(rawQuery, func(r rune) bool { return r == '&' || r == ';' })
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+func canonicalHeaders(headers []string) (string, error) {
+	result := make([]string, 0, len(headers))
+	for _, hdr := range headers {
+		i := strings.Index(hdr, ":")
+		if i <= 0 {
+			return "", fmt.Errorf("invalid header constraint \"%s\", expected \"Name:Value\"", hdr)
+		}
+		result = append(result, http.CanonicalHeaderKey(hdr[:i])+":"+hdr[i+1:])
+	}
+	sort.Strings(result)
+	return strings.Join(result, " "), nil
+}
+
+// QueryConstraints returns the query parameters matching requests must carry
+func (f FuncHttp) QueryConstraints() url.Values {
+	values, _ := url.ParseQuery(f.query)
+	return values
+}
+
+// HeaderConstraints returns the headers matching requests must carry
+func (f FuncHttp) HeaderConstraints() http.Header {
+	result := make(http.Header)
+	for _, hdr := range strings.Fields(f.headers) {
+		i := strings.Index(hdr, ":")
+		result.Add(hdr[:i], hdr[i+1:])
+	}
+	return result
+}
+
+// Constraints returns the number of query and header constraints
+func (f FuncHttp) Constraints() int {
+	return len(f.QueryConstraints()) + len(strings.Fields(f.headers))
+}
+
+// MatchRequest returns true if the query parameters and headers of req
+// satisfy the constraints of the function
+func (f FuncHttp) MatchRequest(req *http.Request) bool {
+	query := req.URL.Query()
+	for name, values := range f.QueryConstraints() {
+		got, ok := query[name]
+		if !ok {
+			return false
+		}
+
+		for _, v := range values {
+			if v != "" && !containsString(got, v) {
+				return false
+			}
+		}
+	}
+
+	for name, values := range f.HeaderConstraints() {
+		got, ok := req.Header[name]
+		if !ok {
+			return false
+		}
+
+		for _, v := range values {
+			if v != "" && !containsString(got, v) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// RequestURI returns the uri including the query string to send requests
+// matching the function to.
+func (f FuncHttp) RequestURI() string {
+	if f.query == "" {
+		return f.uri
+	}
+	return f.uri + "?" + f.query
+}
+
 func (f FuncHttp) IsReference() bool { return true }
-func (f FuncHttp) String() string    { return fmt.Sprintf("%s %s", f.method, f.uri) }
-func (f FuncHttp) Handle(req *http.Request) string {
+func (f FuncHttp) String() string {
+	s := fmt.Sprintf("%s %s", f.method, f.RequestURI())
+	if f.IsGrpc() {
+		s = fmt.Sprintf("%s %s %s:%s", f.method, grpcMethodName(f.path), f.host, f.port)
+	} else if f.IsTopic() {
+		s = fmt.Sprintf("%s %s %s:%s", f.method, f.Topic(), f.host, f.port)
+	}
+	if f.headers != "" {
+		s += " " + f.headers
+	}
+	return s
+}
+func (f FuncHttp) Handle(req *http.Request) *CallResult {
 	return HttpRequest(FuncHttp{}, f, req)
 }
 
@@ -133,53 +233,50 @@ func FuncInHeader(req *http.Request, name string) bool {
 	return false
 }
 
-type RequestFunc func(ownFunc FuncDef, http FuncHttp, inReq *http.Request) string
+type RequestFunc func(ownFunc FuncDef, http FuncHttp, inReq *http.Request) *CallResult
 
-func FuncMux(funcs map[FuncDef]FuncHttp, inReq *http.Request, ownFunc FuncDef, reqFunc RequestFunc) string {
-	responses := make(chan string, 32)
-	var wg sync.WaitGroup
+// FuncMux calls all funcs concurrently and returns the results ordered by
+// function name.
+func FuncMux(funcs map[FuncDef]FuncHttp, inReq *http.Request, ownFunc FuncDef, reqFunc RequestFunc) []*CallResult {
+	keys := make([]FuncDef, 0, len(funcs))
+	for key := range funcs {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
 
-	nreplies := len(funcs)
-	if nreplies == 0 {
-		return ""
+	results := make([]*CallResult, len(keys))
+	if len(keys) == 0 {
+		return results
 	}
-	log.Infof("Waiting for %d responses", nreplies)
-	wg.Add(nreplies)
 
-	for key := range funcs {
-		go func(key FuncDef) {
+	var wg sync.WaitGroup
+	log.Infof("Waiting for %d responses", len(keys))
+	wg.Add(len(keys))
+
+	for i, key := range keys {
+		go func(i int, key FuncDef) {
 			defer wg.Done()
 			log.Infof("Scheduling %+v", key)
 			if key.String() == ownFunc.String() {
-				responses <- fmt.Sprintf("{%s: %s}", JSON(key.String()), JSON("NOP"))
+				results[i] = NewCallResult(key.String())
+				results[i].Verdict = VerdictNOP
 			} else {
-				responses <- reqFunc(ownFunc, funcs[key], inReq)
+				results[i] = reqFunc(ownFunc, funcs[key], inReq)
 			}
 			log.Infof("Done with %+v", key)
-		}(key)
+		}(i, key)
 	}
 
 	wg.Wait()
-	log.Infof("Reading responses")
-
-	ret := ""
-	for i := 0; i < nreplies; i++ {
-		str := <-responses
-		if i > 0 {
-			ret += ",\n"
-		}
-		ret += str
-	}
-
 	log.Infof("Read all responses")
 
-	return ret
+	return results
 }
 
-func Exploit(req *http.Request, ownFunc FuncDef) string {
+func Exploit(req *http.Request, ownFunc FuncDef) []*CallResult {
 	return FuncMux(GetHttpFuncs(req), req, ownFunc, HttpRequest)
 }
 
-func NeighborConnectivity(req *http.Request, ownFunc FuncDef) string {
+func NeighborConnectivity(req *http.Request, ownFunc FuncDef) []*CallResult {
 	return FuncMux(GetHttpFuncs(req), req, ownFunc, PingRequest)
 }
@@ -2,9 +2,13 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/mailgun/manners"
 	"github.com/urfave/cli"
@@ -34,70 +38,237 @@ var (
 	}
 )
 
-func handler(w http.ResponseWriter, req *http.Request) {
-	host := hostName
-	if host == "" {
-		host = req.Host
+// portHandler returns the handler for requests arriving on port. Functions
+// are looked up on the port the request arrived on, under host if given or
+// else under the host name the request was addressed to.
+func portHandler(host string, port FuncPort) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		name := host
+		if name == "" {
+			name = req.Host
+			if h, _, err := net.SplitHostPort(req.Host); err == nil {
+				name = h
+			}
+		}
+
+		handler(w, req, name+":"+string(port))
 	}
+}
+
+func handler(w http.ResponseWriter, req *http.Request, host string) {
 
 	if req.Header.Get("NoOperation") != "" {
+		// gRPC callers expect a reply carrying a gRPC status
+		if IsGrpcRequest(req) {
+			WriteGrpcResponse(w, http.StatusOK, "", nil)
+		}
 		return
 	}
 
-	uri := host + req.URL.Path
-	result := "["
+	req = WithIdentity(req, host)
 
+	uri := host + req.URL.Path
 	funcName := fmt.Sprintf("%s %s", req.Method, uri)
-	def, calls, err := LookupFuncDef(funcName)
+	if IsGrpcRequest(req) {
+		funcName = fmt.Sprintf("%s %s %s", FuncTypeGrpc, grpcMethodName(req.URL.Path), host)
+		if err := UnwrapGrpcRequest(req); err != nil {
+			result := NewErrorResult(funcName, err)
+			WriteResponse(w, req, http.StatusBadRequest, result.JSON(), nil)
+			return
+		}
+	}
+	if IsTopicRequest(req) {
+		funcName = fmt.Sprintf("%s %s %s", req.Method, strings.TrimPrefix(req.URL.Path, topicPathPrefix), host)
+		if req.Method == FuncTypePublish {
+			msgReq, err := WithTopicMessage(req)
+			if err != nil {
+				result := NewErrorResult(funcName, err)
+				WriteResponse(w, req, http.StatusBadRequest, result.JSON(), nil)
+				return
+			}
+			req = msgReq
+		}
+	}
+	def, calls, params, err := LookupFuncDef(funcName, req)
+	if len(params) > 0 {
+		log.Infof("Function %+v matched with parameters %v", def, params)
+		req = WithRouteParams(req, params)
+	}
+
+	// Exploit attempts and neighbor connectivity checks probe reachability
+	// only, the latency, faults, status and request expectations of the
+	// function would mask the outcome.
+	exploit := req.Header.Get("Exploit") != ""
+	neighbor := req.Header.Get("NeighborConnectivity") != ""
+	probe := exploit || neighbor
+
+	var fault *Fault
+	if def != nil && !probe {
+		SimulateLatency(def)
+
+		fault = definitionTree.Faults[def].Pick()
+		if InjectFault(w, req, def, fault) {
+			return
+		}
+	}
+
+	result := NewCallResult(funcName)
+	status := http.StatusOK
+	attrs := definitionTree.Attrs[def]
+	expect := attrs.RequestExpect()
+	if probe {
+		expect = nil
+	}
+
 	if err != nil {
-		result += ErrorReport(err)
+		result.Error = err.Error()
+		status = http.StatusBadRequest
 	} else if def == nil {
-		result += ErrorReport(fmt.Errorf("Function %s not found", funcName))
-	} else if req.Header.Get("NeighborConnectivity") != "" {
-		log.Infof("Function %+v neighbor connectivity", def)
-		result += NeighborConnectivity(req, def)
-	} else if req.Header.Get("Exploit") != "" {
-		log.Infof("Function %+v being exploited", def)
-		exploitCalls := Exploit(req, def)
-		result += exploitCalls
-
-		nonHttpCalls := calls.NonHttp()
-		if len(nonHttpCalls) > 0 && exploitCalls != "" {
-			result += ","
-		}
-		result += nonHttpCalls.Handle(req)
+		result.Error = fmt.Sprintf("Function %s not found", funcName)
+		status = http.StatusNotFound
+	} else if received, code, err := ReadRequestBody(req, expect); err != nil {
+		log.Infof("Function %+v rejected request: %s", def, err)
+		result.Function = def.String()
+		result.Received = received
+		result.Error = err.Error()
+		status = code
 	} else {
-		log.Infof("Function %+v calls: %+v", def, calls)
-		result += calls.Handle(req)
+		result.Function = def.String()
+		result.Received = received
+
+		if neighbor {
+			log.Infof("Function %+v neighbor connectivity", def)
+			result.Children = NeighborConnectivity(req, def)
+		} else if exploit {
+			log.Infof("Function %+v being exploited", def)
+			result.Children = append(Exploit(req, def), calls.NonHttp().Handle(req)...)
+		} else {
+			log.Infof("Function %+v calls: %+v", def, calls)
+			result.Children = calls.Handle(req)
+		}
+
+		if attrs != nil {
+			for name, value := range attrs.Headers {
+				w.Header().Set(name, value)
+			}
+			if !probe {
+				status = attrs.StatusCode()
+			}
+
+			data, err := attrs.Payload.Render(NewPayloadContext(req, def))
+			if err != nil {
+				result.Error = fmt.Sprintf("unable to render payload: %s", err)
+				status = http.StatusInternalServerError
+			}
+			result.Data = data
+		}
 	}
 
-	result += "]"
-	fmt.Fprint(w, PrettyJSON(result))
+	if req.TLS != nil {
+		result.TLS = &TLSInfo{Client: peerIdentity(req.TLS)}
+	}
 
+	WriteResponse(w, req, status, result.JSON(), fault)
 }
 
-func runNode(cli *cli.Context) {
-	if hostName != "" {
-		hostName = hostName + fmt.Sprintf(":%d", ConfigFuncPort)
+// httpPorts returns the ports of all HTTP functions of host, or of all
+// hosts if host is empty. Ports only used by socket functions are left to
+// ServeSockets.
+func httpPorts(host string) []FuncPort {
+	ports := make(map[FuncPort]bool)
+
+	for h, funcPort := range GetExternalFuncTree() {
+		if host != "" && string(h) != host {
+			continue
+		}
+
+		for port, funcNode := range funcPort {
+			for node := range funcNode {
+				if node.method != FuncTypeTCP && node.method != FuncTypeUDP {
+					ports[port] = true
+				}
+			}
+		}
 	}
 
-	addr := fmt.Sprintf(":%d", ConfigFuncPort)
-	log.Info("Listening on %s", addr)
+	result := make([]FuncPort, 0, len(ports))
+	for port := range ports {
+		result = append(result, port)
+	}
+	sortPorts(result)
+	return result
+}
+
+// nodePorts returns the ports to serve functions on, the HTTP ports of host
+// and the default function port.
+func nodePorts(host string) []FuncPort {
+	ports := httpPorts(host)
+
+	funcPort := FuncPort(strconv.Itoa(ConfigFuncPort))
+	for _, port := range ports {
+		if port == funcPort {
+			return ports
+		}
+	}
 
-	s := manners.NewWithServer(&http.Server{
-		Addr:    addr,
-		Handler: http.HandlerFunc(handler),
+	ports = append(ports, funcPort)
+	sortPorts(ports)
+	return ports
+}
+
+// newFuncServer returns the server handling the functions of host on port,
+// see portHandler. The server accepts HTTP/2 with and without TLS to serve
+// gRPC functions.
+func newFuncServer(addr string, host string, port FuncPort) *manners.GracefulServer {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(true)
+
+	return manners.NewWithServer(&http.Server{
+		Addr:      addr,
+		Handler:   portHandler(host, port),
+		Protocols: protocols,
 	})
+}
+
+func runNode(cli *cli.Context) {
+	ServeSockets(hostName)
+
+	var servers []*manners.GracefulServer
+	for _, port := range nodePorts(hostName) {
+		addr := ":" + string(port)
+		log.Infof("Listening on %s", addr)
+
+		servers = append(servers, newFuncServer(addr, hostName, port))
+	}
 
 	go func() {
 		sigchan := make(chan os.Signal, 1)
 		signal.Notify(sigchan, os.Interrupt, os.Kill)
 		<-sigchan
 		log.Info("Shutting down...")
-		s.Close()
+		for _, s := range servers {
+			s.Close()
+		}
 	}()
 
-	if err := s.ListenAndServe(); err != nil {
-		log.Fatal(err)
+	// A node serving a single host only presents the certificate of that
+	// host, a node serving all hosts presents the one requested.
+	names := []string{hostName}
+	if hostName == "" {
+		names = sortedHosts(GetExternalFuncTree())
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(servers))
+	for _, s := range servers {
+		go func(s *manners.GracefulServer) {
+			defer wg.Done()
+			if err := listenAndServe(s, names, MutualTLS); err != nil {
+				log.Fatal(err)
+			}
+		}(s)
 	}
+	wg.Wait()
 }
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+var (
+	graphFormat  string
+	graphOutput  string
+	graphOverlay string
+
+	GraphCommand = cli.Command{
+		Name:     "graph",
+		Usage:    "Export the call graph as Graphviz DOT or Mermaid",
+		Category: "Definition",
+		Action:   runGraph,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Destination: &graphFormat,
+				Name:        "f, format",
+				Value:       GraphFormatDOT,
+				Usage:       "Output format: dot or mermaid",
+			},
+			cli.StringFlag{
+				Destination: &graphOutput,
+				Name:        "o, output",
+				Usage:       "Path of the file to write the graph to instead of stdout",
+			},
+			cli.StringFlag{
+				Destination: &graphOverlay,
+				Name:        "overlay",
+				Usage:       "Verification result written by \"verify -f json\" to overlay",
+			},
+		},
+	}
+)
+
+const (
+	GraphFormatDOT     = "dot"
+	GraphFormatMermaid = "mermaid"
+
+	graphKindHttp    = "http"
+	graphKindCall    = "call"
+	graphKindData    = "data"
+	graphKindVuln    = "vuln"
+	graphKindBlocked = "blocked"
+)
+
+type graphNode struct {
+	ID    string
+	Label string
+	Kind  string
+}
+
+type graphEdge struct {
+	From string
+	To   string
+	Kind string
+}
+
+type graphPort struct {
+	Port  FuncPort
+	Nodes []*graphNode
+}
+
+type graphHost struct {
+	Host  FuncHost
+	Ports []*graphPort
+}
+
+// callGraph is the FuncTree with the functions served by hosts grouped by
+// host and port. CALL functions and DATA values are not served by a host.
+type callGraph struct {
+	Hosts []*graphHost
+	Other []*graphNode
+	Edges []graphEdge
+
+	nodes map[string]*graphNode
+}
+
+// nodeLabel returns the name of a function without the host and port it
+// is grouped under.
+func nodeLabel(def FuncDef) string {
+	hf, ok := def.(FuncHttp)
+	if !ok {
+		return def.String()
+	}
+
+	label := strings.Replace(hf.String(), string(hf.host)+":"+string(hf.port), "", 1)
+	return strings.Join(strings.Fields(label), " ")
+}
+
+func (g *callGraph) node(def FuncDef, kind string) *graphNode {
+	if n, ok := g.nodes[def.String()]; ok {
+		return n
+	}
+
+	n := &graphNode{ID: fmt.Sprintf("n%d", len(g.nodes)), Label: nodeLabel(def), Kind: kind}
+	g.nodes[def.String()] = n
+	return n
+}
+
+func newCallGraph() *callGraph {
+	g := &callGraph{nodes: make(map[string]*graphNode)}
+
+	var keys []FuncDef
+	for key := range definitionTree.Funcs {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+
+	hosts := make(map[FuncHost]*graphHost)
+	ports := make(map[string]*graphPort)
+	for _, key := range keys {
+		hf, ok := key.(FuncHttp)
+		if !ok {
+			kind := graphKindCall
+			if _, ok := key.(FuncData); ok {
+				kind = graphKindData
+			}
+			g.Other = append(g.Other, g.node(key, kind))
+			continue
+		}
+
+		h, ok := hosts[hf.host]
+		if !ok {
+			h = &graphHost{Host: hf.host}
+			hosts[hf.host] = h
+			g.Hosts = append(g.Hosts, h)
+		}
+
+		p, ok := ports[string(hf.host)+":"+string(hf.port)]
+		if !ok {
+			p = &graphPort{Port: hf.port}
+			ports[string(hf.host)+":"+string(hf.port)] = p
+			h.Ports = append(h.Ports, p)
+		}
+
+		p.Nodes = append(p.Nodes, g.node(key, graphKindHttp))
+	}
+
+	sort.Slice(g.Hosts, func(i, j int) bool { return g.Hosts[i].Host < g.Hosts[j].Host })
+	for _, h := range g.Hosts {
+		sort.Slice(h.Ports, func(i, j int) bool { return portNumber(h.Ports[i].Port) < portNumber(h.Ports[j].Port) })
+	}
+
+	for _, key := range keys {
+		from := g.nodes[key.String()]
+		for _, call := range definitionTree.Funcs[key] {
+			switch call.(type) {
+			case FuncHttp:
+				g.Edges = append(g.Edges, graphEdge{from.ID, g.nodes[call.String()].ID, graphKindHttp})
+			case FuncCall:
+				g.Edges = append(g.Edges, graphEdge{from.ID, g.nodes[call.String()].ID, graphKindCall})
+			case FuncData:
+				n := len(g.nodes)
+				to := g.node(call, graphKindData)
+				if len(g.nodes) > n {
+					g.Other = append(g.Other, to)
+				}
+				g.Edges = append(g.Edges, graphEdge{from.ID, to.ID, graphKindData})
+			}
+		}
+	}
+
+	return g
+}
+
+// overlay marks defined calls blocked in any of the reports and adds the
+// calls found reachable although not defined.
+func (g *callGraph) overlay(reports []*VerifyReport) {
+	vuln := make(map[graphEdge]bool)
+	blocked := make(map[graphEdge]bool)
+	for _, r := range reports {
+		for _, c := range r.Failures() {
+			from, ok := g.nodes[c.Caller]
+			to, ok2 := g.nodes[c.Callee]
+			if !ok || !ok2 {
+				continue
+			}
+
+			switch c.Outcome() {
+			case OutcomeVuln:
+				vuln[graphEdge{from.ID, to.ID, graphKindVuln}] = true
+			case OutcomeBlocked:
+				blocked[graphEdge{from.ID, to.ID, graphKindHttp}] = true
+			}
+		}
+	}
+
+	for i, e := range g.Edges {
+		if blocked[e] {
+			g.Edges[i].Kind = graphKindBlocked
+		}
+	}
+
+	var added []graphEdge
+	for e := range vuln {
+		added = append(added, e)
+	}
+	sort.Slice(added, func(i, j int) bool {
+		return added[i].From < added[j].From || (added[i].From == added[j].From && added[i].To < added[j].To)
+	})
+	g.Edges = append(g.Edges, added...)
+}
+
+var dotEdgeAttrs = map[string]string{
+	graphKindHttp:    "",
+	graphKindCall:    " [style=dashed]",
+	graphKindData:    " [style=dotted, arrowhead=none]",
+	graphKindVuln:    " [color=red, fontcolor=red, label=\"VULN\", constraint=false]",
+	graphKindBlocked: " [color=orange, fontcolor=orange, label=\"blocked\"]",
+}
+
+var dotNodeAttrs = map[string]string{
+	graphKindHttp: "",
+	graphKindCall: ", shape=ellipse",
+	graphKindData: ", shape=note",
+}
+
+func dotQuote(s string) string {
+	return "\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(s) + "\""
+}
+
+func (g *callGraph) writeDOT(w io.Writer) {
+	fmt.Fprintln(w, "digraph apisim {")
+	fmt.Fprintln(w, "\trankdir=LR;")
+	fmt.Fprintln(w, "\tnode [shape=box];")
+
+	for i, h := range g.Hosts {
+		fmt.Fprintf(w, "\tsubgraph cluster_%d {\n\t\tlabel=%s;\n", i, dotQuote(string(h.Host)))
+		for _, p := range h.Ports {
+			fmt.Fprintf(w, "\t\tsubgraph cluster_%d_%s {\n\t\t\tlabel=%s;\n", i, p.Port, dotQuote(":"+string(p.Port)))
+			for _, n := range p.Nodes {
+				fmt.Fprintf(w, "\t\t\t%s [label=%s];\n", n.ID, dotQuote(n.Label))
+			}
+			fmt.Fprintln(w, "\t\t}")
+		}
+		fmt.Fprintln(w, "\t}")
+	}
+
+	for _, n := range g.Other {
+		fmt.Fprintf(w, "\t%s [label=%s%s];\n", n.ID, dotQuote(n.Label), dotNodeAttrs[n.Kind])
+	}
+
+	for _, e := range g.Edges {
+		fmt.Fprintf(w, "\t%s -> %s%s;\n", e.From, e.To, dotEdgeAttrs[e.Kind])
+	}
+	fmt.Fprintln(w, "}")
+}
+
+var mermaidArrows = map[string]string{
+	graphKindHttp:    "-->",
+	graphKindCall:    "-.->",
+	graphKindData:    "---",
+	graphKindVuln:    "-->|VULN|",
+	graphKindBlocked: "-->|blocked|",
+}
+
+var mermaidColors = map[string]string{
+	graphKindVuln:    "red",
+	graphKindBlocked: "orange",
+}
+
+func mermaidQuote(s string) string {
+	return "\"" + strings.Replace(s, "\"", "#quot;", -1) + "\""
+}
+
+func (g *callGraph) writeMermaid(w io.Writer) {
+	fmt.Fprintln(w, "flowchart LR")
+
+	for i, h := range g.Hosts {
+		fmt.Fprintf(w, "\tsubgraph h%d [%s]\n", i, mermaidQuote(string(h.Host)))
+		for _, p := range h.Ports {
+			fmt.Fprintf(w, "\t\tsubgraph h%d_%s [%s]\n", i, p.Port, mermaidQuote(":"+string(p.Port)))
+			for _, n := range p.Nodes {
+				fmt.Fprintf(w, "\t\t\t%s[%s]\n", n.ID, mermaidQuote(n.Label))
+			}
+			fmt.Fprintln(w, "\t\tend")
+		}
+		fmt.Fprintln(w, "\tend")
+	}
+
+	for _, n := range g.Other {
+		if n.Kind == graphKindData {
+			fmt.Fprintf(w, "\t%s>%s]\n", n.ID, mermaidQuote(n.Label))
+		} else {
+			fmt.Fprintf(w, "\t%s([%s])\n", n.ID, mermaidQuote(n.Label))
+		}
+	}
+
+	for i, e := range g.Edges {
+		fmt.Fprintf(w, "\t%s %s %s\n", e.From, mermaidArrows[e.Kind], e.To)
+		if color, ok := mermaidColors[e.Kind]; ok {
+			fmt.Fprintf(w, "\tlinkStyle %d stroke:%s,color:%s\n", i, color, color)
+		}
+	}
+}
+
+func runGraph(cli *cli.Context) {
+	var write func(*callGraph, io.Writer)
+	switch graphFormat {
+	case GraphFormatDOT:
+		write = (*callGraph).writeDOT
+	case GraphFormatMermaid:
+		write = (*callGraph).writeMermaid
+	default:
+		log.Fatalf("Unknown graph format \"%s\"", graphFormat)
+	}
+
+	g := newCallGraph()
+
+	if graphOverlay != "" {
+		reports, err := readVerifyReports(graphOverlay)
+		if err != nil {
+			log.Fatal(err)
+		}
+		g.overlay(reports)
+	}
+
+	// Render the complete graph before touching the output file
+	buf := new(bytes.Buffer)
+	write(g, buf)
+
+	if graphOutput == "" {
+		if _, err := buf.WriteTo(os.Stdout); err != nil {
+			log.Fatalf("Unable to write graph: %s", err)
+		}
+		return
+	}
+
+	if err := ioutil.WriteFile(graphOutput, buf.Bytes(), 0644); err != nil {
+		log.Fatalf("Unable to write graph to \"%s\": %s", graphOutput, err)
+	}
+}
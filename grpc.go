@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// GRPC functions are served by the node server alongside HTTP functions,
+// using HTTP/2 without TLS (h2c). Every gRPC method accepts a SimRequest
+// and answers with a SimReply as described in proto/apisim.proto. The
+// messages consist of a single field each and are encoded directly.
+
+const (
+	FuncTypeGrpc     = "GRPC"
+	grpcContentType  = "application/grpc"
+	grpcStatusHeader = "Grpc-Status"
+	grpcMsgHeader    = "Grpc-Message"
+)
+
+// gRPC status codes, see https://grpc.github.io/grpc/core/md_doc_statuscodes.html
+const (
+	grpcOK                 = 0
+	grpcUnknown            = 2
+	grpcInvalidArgument    = 3
+	grpcDeadlineExceeded   = 4
+	grpcPermissionDenied   = 7
+	grpcResourceExhausted  = 8
+	grpcFailedPrecondition = 9
+	grpcUnimplemented      = 12
+	grpcInternal           = 13
+	grpcUnavailable        = 14
+	grpcUnauthenticated    = 16
+)
+
+var grpcTransport = newGrpcTransport()
+
+func newGrpcTransport() *http.Transport {
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+
+	return &http.Transport{
+		DialContext: dialContext,
+		Protocols:   protocols,
+	}
+}
+
+// NewFuncGrpc returns the gRPC function "service.Method" served by host.
+// The function is represented as the HTTP/2 POST request it maps to.
+func NewFuncGrpc(method string, host string, headers ...string) (FuncHttp, error) {
+	i := strings.LastIndex(method, ".")
+	if i <= 0 || i == len(method)-1 || strings.Contains(method, "/") {
+		return FuncHttp{}, fmt.Errorf("invalid gRPC method \"%s\", expected \"service.Method\"", method)
+	}
+
+	return NewFuncHttp(FuncTypeGrpc, host+"/"+method[:i]+"/"+method[i+1:], headers...)
+}
+
+// IsGrpc returns true if the function is a gRPC method
+func (f FuncHttp) IsGrpc() bool {
+	return f.method == FuncTypeGrpc
+}
+
+// WireRequest returns the method and path of the HTTP request calling f.
+// gRPC methods are called as HTTP/2 POST requests to /service/Method.
+func (f FuncHttp) WireRequest() (string, string) {
+	if f.IsGrpc() {
+		return http.MethodPost, f.path
+	}
+	return f.method, f.path
+}
+
+// grpcMethodName returns "service.Method" for the request path
+// "/service/Method".
+func grpcMethodName(path string) string {
+	name := strings.TrimPrefix(path, "/")
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[:i] + "." + name[i+1:]
+	}
+	return name
+}
+
+func IsGrpcRequest(req *http.Request) bool {
+	return req.ProtoMajor == 2 && req.Method == http.MethodPost &&
+		strings.HasPrefix(req.Header.Get("Content-Type"), grpcContentType)
+}
+
+// encodeBytesField encodes data as length-delimited protobuf field 1
+func encodeBytesField(data []byte) []byte {
+	buf := make([]byte, 1, len(data)+binary.MaxVarintLen64+1)
+	buf[0] = 1<<3 | 2
+	buf = binary.AppendUvarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+// decodeBytesField returns the value of the length-delimited protobuf
+// field 1 of msg. Unknown fields are skipped.
+func decodeBytesField(msg []byte) ([]byte, error) {
+	var result []byte
+
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid protobuf field key")
+		}
+		msg = msg[n:]
+
+		switch key & 7 {
+		case 0:
+			if _, n = binary.Uvarint(msg); n <= 0 {
+				return nil, fmt.Errorf("invalid protobuf varint")
+			}
+			msg = msg[n:]
+		case 1, 5:
+			size := 8
+			if key&7 == 5 {
+				size = 4
+			}
+			if len(msg) < size {
+				return nil, fmt.Errorf("truncated protobuf message")
+			}
+			msg = msg[size:]
+		case 2:
+			length, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < length {
+				return nil, fmt.Errorf("truncated protobuf message")
+			}
+			if key>>3 == 1 {
+				result = msg[n : n+int(length)]
+			}
+			msg = msg[n+int(length):]
+		default:
+			return nil, fmt.Errorf("unsupported protobuf wire type %d", key&7)
+		}
+	}
+
+	return result, nil
+}
+
+// grpcFrame prefixes msg with the uncompressed gRPC message header
+func grpcFrame(msg []byte) []byte {
+	frame := make([]byte, 5, len(msg)+5)
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	return append(frame, msg...)
+}
+
+// readGrpcMessage reads a single gRPC message from r. It returns io.EOF if
+// r holds no further message.
+func readGrpcMessage(r io.Reader) ([]byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	if hdr[0] != 0 {
+		return nil, fmt.Errorf("compressed gRPC messages are not supported")
+	}
+
+	msg := make([]byte, binary.BigEndian.Uint32(hdr[1:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// NewGrpcRequest returns the HTTP/2 request calling the gRPC function at
+// url with payload as SimRequest payload.
+func NewGrpcRequest(url string, payload []byte) (*http.Request, error) {
+	body := bytes.NewReader(grpcFrame(encodeBytesField(payload)))
+	req, err := http.NewRequest(http.MethodPost, url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", grpcContentType)
+	req.Header.Set("TE", "trailers")
+	return req, nil
+}
+
+// UnwrapGrpcRequest replaces the body of the gRPC request with the payload
+// of the SimRequest it carries.
+func UnwrapGrpcRequest(req *http.Request) error {
+	msg, err := readGrpcMessage(req.Body)
+	if err == io.EOF {
+		msg, err = nil, nil
+	} else if err != nil {
+		return err
+	}
+
+	payload, err := decodeBytesField(msg)
+	if err != nil {
+		return err
+	}
+
+	req.Body = ioutil.NopCloser(bytes.NewReader(payload))
+	return nil
+}
+
+// ReadGrpcResponse returns the result carried by the SimReply of the
+// response along with the gRPC status. A non-zero gRPC status is returned
+// as error along with the result, if any.
+func ReadGrpcResponse(resp *http.Response) ([]byte, int, error) {
+	msg, err := readGrpcMessage(resp.Body)
+	if err != nil && err != io.EOF {
+		return nil, grpcUnknown, err
+	}
+
+	// Trailers are only available once the body has been consumed
+	io.Copy(ioutil.Discard, resp.Body)
+
+	result, err := decodeBytesField(msg)
+	if err != nil {
+		return nil, grpcInternal, err
+	}
+
+	status := resp.Trailer.Get(grpcStatusHeader)
+	message := resp.Trailer.Get(grpcMsgHeader)
+	if status == "" {
+		// Trailers-only responses carry the status in the headers
+		status = resp.Header.Get(grpcStatusHeader)
+		message = resp.Header.Get(grpcMsgHeader)
+	}
+
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return result, grpcUnknown, fmt.Errorf("gRPC response without valid status")
+	} else if code != grpcOK {
+		return result, code, fmt.Errorf("gRPC status %d: %s", code, message)
+	}
+
+	return result, grpcOK, nil
+}
+
+// grpcStatusFromHTTP maps the HTTP status code a function answers with to
+// the closest gRPC status code.
+func grpcStatusFromHTTP(status int) int {
+	switch {
+	case status < 400:
+		return grpcOK
+	case status == http.StatusBadRequest:
+		return grpcInvalidArgument
+	case status == http.StatusUnauthorized:
+		return grpcUnauthenticated
+	case status == http.StatusForbidden:
+		return grpcPermissionDenied
+	case status == http.StatusNotFound:
+		return grpcUnimplemented
+	case status == http.StatusPreconditionFailed:
+		return grpcFailedPrecondition
+	case status == http.StatusRequestEntityTooLarge, status == http.StatusTooManyRequests:
+		return grpcResourceExhausted
+	case status == http.StatusServiceUnavailable, status == http.StatusBadGateway:
+		return grpcUnavailable
+	case status == http.StatusGatewayTimeout:
+		return grpcDeadlineExceeded
+	case status >= 500:
+		return grpcInternal
+	default:
+		return grpcUnknown
+	}
+}
+
+// httpStatusFromGrpc is the inverse of grpcStatusFromHTTP
+func httpStatusFromGrpc(code int) int {
+	switch code {
+	case grpcOK:
+		return http.StatusOK
+	case grpcInvalidArgument:
+		return http.StatusBadRequest
+	case grpcUnauthenticated:
+		return http.StatusUnauthorized
+	case grpcPermissionDenied:
+		return http.StatusForbidden
+	case grpcUnimplemented:
+		return http.StatusNotFound
+	case grpcFailedPrecondition:
+		return http.StatusPreconditionFailed
+	case grpcResourceExhausted:
+		return http.StatusTooManyRequests
+	case grpcUnavailable:
+		return http.StatusServiceUnavailable
+	case grpcDeadlineExceeded:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// WriteGrpcResponse answers a gRPC request with a SimReply carrying body.
+// The HTTP status code of the function is mapped to a gRPC status.
+func WriteGrpcResponse(w http.ResponseWriter, status int, body string, fault *Fault) {
+	frame := grpcFrame(encodeBytesField([]byte(body)))
+	grpcStatus := grpcStatusFromHTTP(status)
+
+	w.Header().Set("Content-Type", grpcContentType)
+	w.Header().Set("Trailer", grpcStatusHeader+", "+grpcMsgHeader)
+	w.WriteHeader(http.StatusOK)
+
+	if fault != nil && fault.Type == FaultTruncate {
+		w.Write(frame[:len(frame)/2])
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+		abortConnection()
+	}
+
+	w.Write(frame)
+	w.Header().Set(grpcStatusHeader, strconv.Itoa(grpcStatus))
+	if grpcStatus != grpcOK {
+		w.Header().Set(grpcMsgHeader, http.StatusText(status))
+	}
+}
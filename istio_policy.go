@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+var (
+	istioPolicyFile  string
+	istioTrustDomain string
+	istioEnvoy       bool
+
+	GenerateIstioPolicyCommand = cli.Command{
+		Name:     "generate-istio-policy",
+		Usage:    "Generate Istio AuthorizationPolicies or Envoy RBAC filter configs",
+		Category: "L7 policy generation",
+		Action:   generateIstioPolicy,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Destination: &istioPolicyFile,
+				Name:        "o, output",
+				Value:       "istio-policy.yaml",
+				Usage:       "Path of the multi-document YAML bundle to write",
+			},
+			cli.StringFlag{
+				Destination: &manifestNamespace,
+				Name:        "n, namespace",
+				Usage:       "Namespace the functions run in",
+			},
+			cli.StringFlag{
+				Destination: &istioTrustDomain,
+				Name:        "trust-domain",
+				Value:       "cluster.local",
+				Usage:       "Trust domain of the mesh identities",
+			},
+			cli.BoolFlag{
+				Destination: &istioEnvoy,
+				Name:        "envoy",
+				Usage:       "Write one Envoy RBAC HTTP filter config per function host instead",
+			},
+		},
+	}
+)
+
+// meshRule lists the calls a caller makes to a port of a host. Rules of the
+// status service have no calls as it may reach any function on the port.
+type meshRule struct {
+	Caller string
+	Port   FuncPort
+	Calls  []FuncHttp
+}
+
+// meshRules returns the rules of host. UDP is not proxied by the mesh and
+// is left to the network policy.
+func meshRules(host FuncHost, funcPort ExternalFuncPort) []meshRule {
+	var rules []meshRule
+
+	for _, port := range sortedPorts(funcPort) {
+		if portProtocols(funcPort[port])[0] != FuncTypeTCP {
+			continue
+		}
+		rules = append(rules, meshRule{Caller: statusIdentity, Port: port})
+
+		calls := make(map[FuncHost]map[string]FuncHttp)
+		for _, caller := range FindCallers(host, port) {
+			for _, call := range definitionTree.Funcs[caller].AllHttp() {
+				if call.host != host || call.port != port || call.Protocol() != FuncTypeTCP {
+					continue
+				}
+				if _, ok := calls[caller.host]; !ok {
+					calls[caller.host] = make(map[string]FuncHttp)
+				}
+				calls[caller.host][call.String()] = call
+			}
+		}
+
+		callers := make([]string, 0, len(calls))
+		for caller := range calls {
+			callers = append(callers, string(caller))
+		}
+		sort.Strings(callers)
+
+		for _, caller := range callers {
+			rule := meshRule{Caller: caller, Port: port}
+			for _, call := range calls[FuncHost(caller)] {
+				rule.Calls = append(rule.Calls, call)
+			}
+			sort.Slice(rule.Calls, func(i, j int) bool {
+				return rule.Calls[i].String() < rule.Calls[j].String()
+			})
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules
+}
+
+// meshPrincipal returns the identity of the workload running host
+func meshPrincipal(host string) string {
+	ns := manifestNamespace
+	if ns == "" {
+		ns = "default"
+	}
+	return fmt.Sprintf("%s/ns/%s/sa/%s", istioTrustDomain, ns, host)
+}
+
+// istioPath returns the path of hf with route parameters converted to
+// Istio path templates. Istio matches paths without the query string so
+// query constraints are not enforced.
+func istioPath(hf FuncHttp) string {
+	_, path := hf.WireRequest()
+	segs := strings.Split(path, "/")
+	for i, seg := range segs {
+		switch {
+		case seg == "*" && i == len(segs)-1:
+			segs[i] = "{**}"
+		case seg == "*" || isParamSegment(seg):
+			segs[i] = "{*}"
+		}
+	}
+	return strings.Join(segs, "/")
+}
+
+type istioPolicySpec struct {
+	Selector k8sSelector `yaml:"selector"`
+	Action   string      `yaml:"action"`
+	Rules    []istioRule `yaml:"rules"`
+}
+
+type istioRule struct {
+	From []istioFrom      `yaml:"from"`
+	To   []istioTo        `yaml:"to"`
+	When []istioCondition `yaml:"when,omitempty"`
+}
+
+type istioFrom struct {
+	Source struct {
+		Principals []string `yaml:"principals"`
+	} `yaml:"source"`
+}
+
+type istioTo struct {
+	Operation istioOperation `yaml:"operation"`
+}
+
+type istioOperation struct {
+	Ports   []string `yaml:"ports"`
+	Methods []string `yaml:"methods,omitempty"`
+	Paths   []string `yaml:"paths,omitempty"`
+}
+
+type istioCondition struct {
+	Key    string   `yaml:"key"`
+	Values []string `yaml:"values"`
+}
+
+// istioRules returns the AuthorizationPolicy rules for r. Calls with
+// header constraints need a rule of their own to carry the conditions.
+func istioRules(r meshRule) []istioRule {
+	from := istioFrom{}
+	from.Source.Principals = []string{meshPrincipal(r.Caller)}
+	ports := []string{string(r.Port)}
+
+	if len(r.Calls) == 0 {
+		return []istioRule{{From: []istioFrom{from}, To: []istioTo{{istioOperation{Ports: ports}}}}}
+	}
+
+	rules := []istioRule{{From: []istioFrom{from}}}
+	for _, call := range r.Calls {
+		op := istioOperation{Ports: ports}
+		if !call.IsSocket() {
+			method, _ := call.WireRequest()
+			op.Methods = []string{method}
+			op.Paths = []string{istioPath(call)}
+		}
+
+		if call.headers == "" {
+			rules[0].To = append(rules[0].To, istioTo{op})
+			continue
+		}
+
+		rule := istioRule{From: []istioFrom{from}, To: []istioTo{{op}}}
+		for name, values := range call.HeaderConstraints() {
+			if values[0] == "" {
+				values = []string{"*"}
+			}
+			rule.When = append(rule.When, istioCondition{fmt.Sprintf("request.headers[%s]", name), values})
+		}
+		sort.Slice(rule.When, func(i, j int) bool { return rule.When[i].Key < rule.When[j].Key })
+		rules = append(rules, rule)
+	}
+
+	if len(rules[0].To) == 0 {
+		rules = rules[1:]
+	}
+	return rules
+}
+
+type envoyStringMatch struct {
+	Exact     string          `yaml:"exact,omitempty"`
+	SafeRegex *envoySafeRegex `yaml:"safe_regex,omitempty"`
+}
+
+type envoySafeRegex struct {
+	Regex string `yaml:"regex"`
+}
+
+type envoyHeaderMatch struct {
+	Name         string            `yaml:"name"`
+	StringMatch  *envoyStringMatch `yaml:"string_match,omitempty"`
+	PresentMatch bool              `yaml:"present_match,omitempty"`
+}
+
+type envoyPermission struct {
+	AndRules        *envoyRules       `yaml:"and_rules,omitempty"`
+	DestinationPort int               `yaml:"destination_port,omitempty"`
+	Header          *envoyHeaderMatch `yaml:"header,omitempty"`
+	URLPath         *envoyPathMatch   `yaml:"url_path,omitempty"`
+}
+
+type envoyRules struct {
+	Rules []envoyPermission `yaml:"rules"`
+}
+
+type envoyPathMatch struct {
+	Path envoyStringMatch `yaml:"path"`
+}
+
+type envoyPrincipal struct {
+	Authenticated struct {
+		PrincipalName envoyStringMatch `yaml:"principal_name"`
+	} `yaml:"authenticated"`
+}
+
+type envoyPolicy struct {
+	Permissions []envoyPermission `yaml:"permissions"`
+	Principals  []envoyPrincipal  `yaml:"principals"`
+}
+
+type envoyRBACFilter struct {
+	Name        string `yaml:"name"`
+	TypedConfig struct {
+		Type  string `yaml:"@type"`
+		Rules struct {
+			Action   string                 `yaml:"action"`
+			Policies map[string]envoyPolicy `yaml:"policies"`
+		} `yaml:"rules"`
+	} `yaml:"typed_config"`
+}
+
+// envoyPermissions returns the permissions for r, one per call, each
+// matching the port, method, path and headers of the call.
+func envoyPermissions(r meshRule) []envoyPermission {
+	port := envoyPermission{DestinationPort: portNumber(r.Port)}
+	if len(r.Calls) == 0 {
+		return []envoyPermission{port}
+	}
+
+	var permissions []envoyPermission
+	for _, call := range r.Calls {
+		if call.IsSocket() {
+			permissions = append(permissions, port)
+			continue
+		}
+
+		method, callPath := call.WireRequest()
+		path := envoyStringMatch{Exact: callPath}
+		if IsRoutePattern(callPath) {
+			path = envoyStringMatch{SafeRegex: &envoySafeRegex{RouteRegex(callPath)}}
+		}
+
+		rules := []envoyPermission{
+			port,
+			{Header: &envoyHeaderMatch{Name: ":method", StringMatch: &envoyStringMatch{Exact: method}}},
+			{URLPath: &envoyPathMatch{path}},
+		}
+		for _, hdr := range strings.Fields(call.headers) {
+			i := strings.Index(hdr, ":")
+			match := &envoyHeaderMatch{Name: strings.ToLower(hdr[:i])}
+			if hdr[i+1:] == "" {
+				match.PresentMatch = true
+			} else {
+				match.StringMatch = &envoyStringMatch{Exact: hdr[i+1:]}
+			}
+			rules = append(rules, envoyPermission{Header: match})
+		}
+
+		permissions = append(permissions, envoyPermission{AndRules: &envoyRules{rules}})
+	}
+
+	return permissions
+}
+
+func newEnvoyRBACFilter(rules []meshRule) *envoyRBACFilter {
+	filter := &envoyRBACFilter{Name: "envoy.filters.http.rbac"}
+	filter.TypedConfig.Type = "type.googleapis.com/envoy.extensions.filters.http.rbac.v3.RBAC"
+	filter.TypedConfig.Rules.Action = "ALLOW"
+	filter.TypedConfig.Rules.Policies = make(map[string]envoyPolicy)
+
+	for _, r := range rules {
+		principal := envoyPrincipal{}
+		principal.Authenticated.PrincipalName.Exact = "spiffe://" + meshPrincipal(r.Caller)
+
+		name := r.Caller + "-" + string(r.Port)
+		filter.TypedConfig.Rules.Policies[name] = envoyPolicy{
+			Permissions: envoyPermissions(r),
+			Principals:  []envoyPrincipal{principal},
+		}
+	}
+
+	return filter
+}
+
+func generateIstioPolicy(cli *cli.Context) {
+	tree := GetExternalFuncTree()
+
+	hosts := sortedHosts(tree)
+
+	objects := []interface{}{}
+	for _, host := range hosts {
+		rules := meshRules(FuncHost(host), tree[FuncHost(host)])
+
+		if istioEnvoy {
+			path := host + "_envoy_rbac.yaml"
+			writeManifests(path, []interface{}{newEnvoyRBACFilter(rules)}, "Envoy RBAC filter")
+			continue
+		}
+
+		spec := &istioPolicySpec{Selector: *podSelector(host), Action: "ALLOW"}
+		for _, r := range rules {
+			spec.Rules = append(spec.Rules, istioRules(r)...)
+		}
+
+		policy := newK8sObject("security.istio.io/v1", "AuthorizationPolicy", "policy-"+host)
+		policy.Spec = spec
+		objects = append(objects, policy)
+	}
+
+	if !istioEnvoy {
+		writeManifests(istioPolicyFile, objects, "AuthorizationPolicies")
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+var (
+	policyEgress bool
+	dnsNamespace string
+	dnsSelector  string
+
+	egressFlags = []cli.Flag{
+		cli.BoolFlag{
+			Destination: &policyEgress,
+			Name:        "egress",
+			Usage:       "Restrict egress of each function node to DNS and the functions it calls",
+		},
+		cli.StringFlag{
+			Destination: &dnsNamespace,
+			Name:        "dns-namespace",
+			Value:       "kube-system",
+			Usage:       "Namespace of the cluster DNS pods egress is allowed to",
+		},
+		cli.StringFlag{
+			Destination: &dnsSelector,
+			Name:        "dns-selector",
+			Value:       "k8s-app=kube-dns",
+			Usage:       "Comma separated key=value labels selecting the cluster DNS pods",
+		},
+	}
+)
+
+// parseLabels parses a comma separated list of key=value labels
+func parseLabels(s string) map[string]string {
+	labels := make(map[string]string)
+	for _, l := range strings.Split(s, ",") {
+		if l = strings.TrimSpace(l); l == "" {
+			continue
+		}
+
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			log.Fatalf("Invalid label \"%s\", must be key=value", l)
+		}
+		labels[kv[0]] = kv[1]
+	}
+	return labels
+}
+
+// dnsEgressRule returns the rule allowing name resolution via the cluster DNS
+func dnsEgressRule() k8sPolicyRule {
+	return k8sPolicyRule{
+		To: []k8sPolicyPeer{{
+			NamespaceSelector: &k8sSelector{
+				MatchLabels: map[string]string{"kubernetes.io/metadata.name": dnsNamespace},
+			},
+			PodSelector: &k8sSelector{MatchLabels: parseLabels(dnsSelector)},
+		}},
+		Ports: []k8sPolicyPort{{FuncTypeUDP, 53}, {FuncTypeTCP, 53}},
+	}
+}
+
+// egressRules returns the egress rules of host, a DNS allowance followed by
+// one rule per called host allowing exactly the ports and protocols of the
+// calls made.
+func egressRules(host FuncHost) []k8sPolicyRule {
+	ports := make(map[FuncHost]map[k8sPolicyPort]bool)
+	for _, c := range GetUniqueHttpCalls()[host] {
+		if _, ok := ports[c.host]; !ok {
+			ports[c.host] = make(map[k8sPolicyPort]bool)
+		}
+		ports[c.host][k8sPolicyPort{c.Protocol(), portNumber(c.port)}] = true
+	}
+
+	callees := make([]string, 0, len(ports))
+	for callee := range ports {
+		callees = append(callees, string(callee))
+	}
+	sort.Strings(callees)
+
+	rules := []k8sPolicyRule{dnsEgressRule()}
+	for _, callee := range callees {
+		rule := k8sPolicyRule{
+			To: []k8sPolicyPeer{{PodSelector: podSelector(callee)}},
+		}
+		for p := range ports[FuncHost(callee)] {
+			rule.Ports = append(rule.Ports, p)
+		}
+		sort.Slice(rule.Ports, func(i, j int) bool {
+			a, b := rule.Ports[i], rule.Ports[j]
+			return a.Port < b.Port || (a.Port == b.Port && a.Protocol < b.Protocol)
+		})
+		rules = append(rules, rule)
+	}
+
+	return rules
+}
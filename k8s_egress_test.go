@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestEgressRulesThroughCall(t *testing.T) {
+	defer func(tree *FuncTree) { definitionTree = tree }(definitionTree)
+	definitionTree = NewFuncTree()
+
+	def := `{
+		"Functions": {
+			"GET function-a/": [ "CALL lookup" ],
+			"CALL lookup": [ "CALL fetch" ],
+			"CALL fetch": [ "GET function-b:9090/", "TCP db:5432" ],
+			"GET function-b:9090/": [],
+			"TCP db:5432": []
+		}
+	}`
+	if err := json.Unmarshal([]byte(def), definitionTree); err != nil {
+		t.Fatal(err)
+	}
+
+	rules := egressRules("function-a")
+	if len(rules) != 3 {
+		t.Fatalf("expected DNS rule and one rule per callee, got %+v", rules)
+	}
+
+	expected := map[string][]k8sPolicyPort{
+		"db":         {{FuncTypeTCP, 5432}},
+		"function-b": {{FuncTypeTCP, 9090}},
+	}
+	for _, rule := range rules[1:] {
+		callee := rule.To[0].PodSelector.MatchLabels[manifestLabel]
+		if !reflect.DeepEqual(rule.Ports, expected[callee]) {
+			t.Errorf("egress to %s allows %+v, expected %+v", callee, rule.Ports, expected[callee])
+		}
+		delete(expected, callee)
+	}
+	if len(expected) > 0 {
+		t.Errorf("no egress rule to %v", expected)
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	manifestLabel     = "apisim"
+	manifestConfigDir = "/etc/apisim"
+)
+
+var (
+	manifestFile      string
+	manifestNamespace string
+	manifestImage     string
+
+	GenerateK8sManifestsCommand = cli.Command{
+		Name:     "generate-k8s-manifests",
+		Usage:    "Generate apps/v1 Deployments, Services and networking.k8s.io/v1 NetworkPolicies",
+		Category: "Kubernetes spec file generation",
+		Action:   generateK8sManifests,
+		Flags: append([]cli.Flag{
+			cli.StringFlag{
+				Destination: &manifestFile,
+				Name:        "o, output",
+				Value:       "apisim.yaml",
+				Usage:       "Path of the multi-document YAML bundle to write",
+			},
+			cli.StringFlag{
+				Destination: &manifestNamespace,
+				Name:        "n, namespace",
+				Usage:       "Namespace to create and place all objects in",
+			},
+			cli.StringFlag{
+				Destination: &manifestImage,
+				Name:        "image",
+				Value:       "tgraf/apisim:latest",
+				Usage:       "Image to run the function nodes from",
+			},
+			cli.IntFlag{
+				Destination: &statusPort,
+				Value:       8888,
+				Name:        "p, port",
+				Usage:       "Port of the status service",
+			},
+		}, egressFlags...),
+	}
+)
+
+type k8sMeta struct {
+	Name      string            `yaml:"name"`
+	Namespace string            `yaml:"namespace,omitempty"`
+	Labels    map[string]string `yaml:"labels,omitempty"`
+}
+
+type k8sObject struct {
+	APIVersion string            `yaml:"apiVersion"`
+	Kind       string            `yaml:"kind"`
+	Metadata   k8sMeta           `yaml:"metadata"`
+	Spec       interface{}       `yaml:"spec,omitempty"`
+	Data       map[string]string `yaml:"data,omitempty"`
+}
+
+type k8sSelector struct {
+	MatchLabels map[string]string `yaml:"matchLabels" json:"matchLabels"`
+}
+
+type k8sDeploymentSpec struct {
+	Replicas int         `yaml:"replicas"`
+	Selector k8sSelector `yaml:"selector"`
+	Template struct {
+		Metadata k8sMeta    `yaml:"metadata"`
+		Spec     k8sPodSpec `yaml:"spec"`
+	} `yaml:"template"`
+}
+
+type k8sPodSpec struct {
+	ServiceAccountName string         `yaml:"serviceAccountName,omitempty"`
+	Containers         []k8sContainer `yaml:"containers"`
+	Volumes            []k8sVolume    `yaml:"volumes,omitempty"`
+}
+
+type k8sContainer struct {
+	Name         string             `yaml:"name"`
+	Image        string             `yaml:"image"`
+	Args         []string           `yaml:"args"`
+	Ports        []k8sContainerPort `yaml:"ports,omitempty"`
+	VolumeMounts []k8sVolumeMount   `yaml:"volumeMounts,omitempty"`
+}
+
+type k8sContainerPort struct {
+	Name          string `yaml:"name"`
+	ContainerPort int    `yaml:"containerPort"`
+	Protocol      string `yaml:"protocol"`
+}
+
+type k8sVolume struct {
+	Name      string `yaml:"name"`
+	ConfigMap struct {
+		Name  string         `yaml:"name"`
+		Items []k8sKeyToPath `yaml:"items,omitempty"`
+	} `yaml:"configMap"`
+}
+
+type k8sKeyToPath struct {
+	Key  string `yaml:"key"`
+	Path string `yaml:"path"`
+}
+
+type k8sVolumeMount struct {
+	Name      string `yaml:"name"`
+	MountPath string `yaml:"mountPath"`
+	ReadOnly  bool   `yaml:"readOnly"`
+}
+
+type k8sServiceSpec struct {
+	Selector map[string]string `yaml:"selector"`
+	Ports    []k8sServicePort  `yaml:"ports"`
+}
+
+type k8sServicePort struct {
+	Name       string `yaml:"name"`
+	Port       int    `yaml:"port"`
+	Protocol   string `yaml:"protocol"`
+	TargetPort string `yaml:"targetPort"`
+}
+
+type k8sPolicySpec struct {
+	PodSelector k8sSelector     `yaml:"podSelector"`
+	PolicyTypes []string        `yaml:"policyTypes"`
+	Ingress     []k8sPolicyRule `yaml:"ingress,omitempty"`
+	Egress      []k8sPolicyRule `yaml:"egress,omitempty"`
+}
+
+type k8sPolicyRule struct {
+	From  []k8sPolicyPeer `yaml:"from,omitempty" json:"from,omitempty"`
+	To    []k8sPolicyPeer `yaml:"to,omitempty" json:"to,omitempty"`
+	Ports []k8sPolicyPort `yaml:"ports,omitempty" json:"ports,omitempty"`
+}
+
+type k8sPolicyPeer struct {
+	NamespaceSelector *k8sSelector `yaml:"namespaceSelector,omitempty" json:"namespaceSelector,omitempty"`
+	PodSelector       *k8sSelector `yaml:"podSelector,omitempty" json:"podSelector,omitempty"`
+}
+
+type k8sPolicyPort struct {
+	Protocol string `yaml:"protocol" json:"protocol"`
+	Port     int    `yaml:"port" json:"port"`
+}
+
+func newK8sObject(apiVersion string, kind string, name string) *k8sObject {
+	return &k8sObject{
+		APIVersion: apiVersion,
+		Kind:       kind,
+		Metadata: k8sMeta{
+			Name:      name,
+			Namespace: manifestNamespace,
+			Labels:    map[string]string{manifestLabel: name},
+		},
+	}
+}
+
+func podSelector(name string) *k8sSelector {
+	return &k8sSelector{MatchLabels: map[string]string{manifestLabel: name}}
+}
+
+func portNumber(port FuncPort) int {
+	n, err := strconv.Atoi(string(port))
+	if err != nil {
+		log.Fatalf("Invalid port \"%s\"", port)
+	}
+	return n
+}
+
+// manifestDeployment returns the Deployment running apisim with args and
+// the ServiceAccount it runs as, giving each function its own identity.
+func manifestDeployment(name string, attrs *FuncAttrs, volume k8sVolume, ports []k8sContainerPort, args ...string) []interface{} {
+	spec := &k8sDeploymentSpec{
+		Replicas: attrs.Replicas,
+		Selector: *podSelector(name),
+	}
+
+	labels := map[string]string{manifestLabel: name}
+	for k, v := range attrs.Labels {
+		labels[k] = v
+	}
+	spec.Template.Metadata = k8sMeta{Labels: labels}
+
+	spec.Template.Spec = k8sPodSpec{
+		ServiceAccountName: name,
+		Containers: []k8sContainer{{
+			Name:  name,
+			Image: manifestImage,
+			Args: append([]string{
+				"-c", path.Join(manifestConfigDir, filepath.Base(configFile)),
+				"--func-port", fmt.Sprint(ConfigFuncPort),
+			}, args...),
+			Ports:        ports,
+			VolumeMounts: []k8sVolumeMount{{Name: "config", MountPath: manifestConfigDir, ReadOnly: true}},
+		}},
+		Volumes: []k8sVolume{volume},
+	}
+
+	obj := newK8sObject("apps/v1", "Deployment", name)
+	obj.Spec = spec
+	return []interface{}{newK8sObject("v1", "ServiceAccount", name), obj}
+}
+
+// manifestIngress returns the ingress rules of host, one per port allowing
+// the status service and all callers of functions on that port.
+func manifestIngress(host FuncHost, funcPort ExternalFuncPort) []k8sPolicyRule {
+	var rules []k8sPolicyRule
+
+	for _, port := range sortedPorts(funcPort) {
+		rule := k8sPolicyRule{
+			From: []k8sPolicyPeer{{PodSelector: podSelector(statusIdentity)}},
+		}
+
+		callers := []string{}
+		for caller := range FindCallers(host, port).L4Callers() {
+			callers = append(callers, string(caller))
+		}
+		sort.Strings(callers)
+		for _, caller := range callers {
+			rule.From = append(rule.From, k8sPolicyPeer{PodSelector: podSelector(caller)})
+		}
+
+		for _, proto := range portProtocols(funcPort[port]) {
+			rule.Ports = append(rule.Ports, k8sPolicyPort{proto, portNumber(port)})
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules
+}
+
+// payloadFiles returns the files referenced by payloads of the definition,
+// relative to the directory of the definition file.
+func payloadFiles() ([]string, error) {
+	baseDir, err := filepath.Abs(definitionTree.BaseDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var payloads []*Payload
+	for _, attrs := range definitionTree.Attrs {
+		payloads = append(payloads, attrs.Payload)
+	}
+	for _, calls := range definitionTree.Funcs {
+		for _, call := range calls {
+			if hf, ok := call.(FuncHttp); ok && hf.body != nil {
+				payloads = append(payloads, hf.body.Payload)
+			}
+		}
+	}
+
+	files := make(map[string]bool)
+	for _, p := range payloads {
+		if p == nil || p.File == "" {
+			continue
+		}
+
+		file, err := filepath.Abs(p.File)
+		if err != nil {
+			return nil, err
+		}
+		rel, err := filepath.Rel(baseDir, file)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("payload file \"%s\" is not below the directory of the definition", p.File)
+		}
+		files[filepath.ToSlash(rel)] = true
+	}
+
+	var result []string
+	for file := range files {
+		result = append(result, file)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+var configMapKeyInvalid = regexp.MustCompile(`[^-._a-zA-Z0-9]`)
+
+// manifestConfig returns the ConfigMap holding the definition and all
+// payload files it references along with the volume mounting them at the
+// paths they are referenced by.
+func manifestConfig() (*k8sObject, k8sVolume) {
+	cm := newK8sObject("v1", "ConfigMap", "apisim-config")
+	cm.Data = make(map[string]string)
+
+	volume := k8sVolume{Name: "config"}
+	volume.ConfigMap.Name = cm.Metadata.Name
+
+	files, err := payloadFiles()
+	if err != nil {
+		log.Fatalf("Unable to include payload files: %s", err)
+	}
+
+	for _, file := range append([]string{filepath.Base(configFile)}, files...) {
+		path := filepath.Join(definitionTree.BaseDir, filepath.FromSlash(file))
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Fatalf("Unable to read \"%s\": %s", path, err)
+		}
+
+		key := configMapKeyInvalid.ReplaceAllString(file, "_")
+		if _, ok := cm.Data[key]; ok {
+			log.Fatalf("Files \"%s\" and \"%s\" map to the same ConfigMap key", file, key)
+		}
+		cm.Data[key] = string(content)
+		volume.ConfigMap.Items = append(volume.ConfigMap.Items, k8sKeyToPath{key, file})
+	}
+
+	return cm, volume
+}
+
+func generateK8sManifests(cli *cli.Context) {
+	tree := GetExternalFuncTree()
+	objects := []interface{}{}
+
+	if manifestNamespace != "" {
+		ns := newK8sObject("v1", "Namespace", manifestNamespace)
+		ns.Metadata.Namespace = ""
+		objects = append(objects, ns)
+	}
+
+	cm, volume := manifestConfig()
+	objects = append(objects, cm)
+
+	hosts := sortedHosts(tree)
+
+	for _, host := range hosts {
+		funcPort := tree[FuncHost(host)]
+
+		var containerPorts []k8sContainerPort
+		svc := &k8sServiceSpec{Selector: podSelector(host).MatchLabels}
+		for _, port := range sortedPorts(funcPort) {
+			for _, proto := range portProtocols(funcPort[port]) {
+				name := portName(port, proto)
+				containerPorts = append(containerPorts, k8sContainerPort{name, portNumber(port), proto})
+				svc.Ports = append(svc.Ports, k8sServicePort{name, portNumber(port), proto, name})
+			}
+		}
+
+		objects = append(objects, manifestDeployment(host, GetHostAttrs(FuncHost(host)), volume,
+			containerPorts, "node-server", "-n", host)...)
+
+		service := newK8sObject("v1", "Service", host)
+		service.Spec = svc
+		objects = append(objects, service)
+
+		policy := &k8sPolicySpec{
+			PodSelector: *podSelector(host),
+			PolicyTypes: []string{"Ingress"},
+			Ingress:     manifestIngress(FuncHost(host), funcPort),
+		}
+		if policyEgress {
+			policy.PolicyTypes = append(policy.PolicyTypes, "Egress")
+			policy.Egress = egressRules(FuncHost(host))
+		}
+
+		np := newK8sObject("networking.k8s.io/v1", "NetworkPolicy", "policy-"+host)
+		np.Spec = policy
+		objects = append(objects, np)
+	}
+
+	// status can reach all functions
+	statusPorts := []k8sContainerPort{{"status", statusPort, FuncTypeTCP}}
+	statusAttrs := &FuncAttrs{Replicas: 1}
+	objects = append(objects, manifestDeployment(statusIdentity, statusAttrs, volume, statusPorts,
+		"status-server", "-p", fmt.Sprint(statusPort))...)
+
+	service := newK8sObject("v1", "Service", statusIdentity)
+	service.Spec = &k8sServiceSpec{
+		Selector: podSelector(statusIdentity).MatchLabels,
+		Ports:    []k8sServicePort{{"status", statusPort, FuncTypeTCP, "status"}},
+	}
+	objects = append(objects, service)
+
+	writeManifests(manifestFile, objects, "k8s manifests")
+}
+
+// writeManifests writes objects to path as a multi-document YAML bundle
+func writeManifests(path string, objects []interface{}, typ string) {
+	log.Infof("Generating %s %s...", typ, path)
+	out, err := os.Create(path)
+	if err != nil {
+		log.Fatalf("Unable to open manifest file \"%s\" for writing: %s", path, err)
+	}
+
+	defer out.Close()
+
+	encoder := yaml.NewEncoder(out)
+	encoder.SetIndent(2)
+	for _, obj := range objects {
+		if err := encoder.Encode(obj); err != nil {
+			log.Fatalf("Unable to write manifest file: %s", err)
+		}
+	}
+
+	if err := encoder.Close(); err != nil {
+		log.Fatalf("Unable to write manifest file: %s", err)
+	}
+}
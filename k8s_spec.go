@@ -1,8 +1,11 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
+	"sort"
+	"strconv"
 	"text/template"
 
 	"github.com/urfave/cli"
@@ -20,28 +23,70 @@ var (
 		Usage:    "Generate k8s NetworkPolicy specs",
 		Category: "Kubernetes spec file generation",
 		Action:   generateK8sNetPolicy,
+		Flags:    egressFlags,
 	}
 )
 
 type PolicyTemplate struct {
 	Name   FuncHost
 	Policy string
+	Egress string
 }
 
 func writeSpec(template *template.Template, templateConfig interface{}, path string, typ string) {
 	log.Infof("Generating k8s %s %s...", typ, path)
 	spec, err := os.Create(path)
 	if err != nil {
-		log.Fatal("Unable to open spec file \"%s\" for writing: %s", path, err)
+		log.Fatalf("Unable to open spec file \"%s\" for writing: %s", path, err)
 	}
 
 	defer spec.Close()
 
 	if err := template.Execute(spec, templateConfig); err != nil {
-		log.Fatal("Unable to write spec file: %s", err)
+		log.Fatalf("Unable to write spec file: %s", err)
 	}
 }
 
+// portProtocols returns the L4 protocols the functions served on a port
+// are reached over.
+func portProtocols(node ExternalFuncNode) []string {
+	tcp, udp := false, false
+	for n := range node {
+		if n.method == FuncTypeUDP {
+			udp = true
+		} else {
+			tcp = true
+		}
+	}
+
+	result := []string{}
+	if tcp {
+		result = append(result, FuncTypeTCP)
+	}
+	if udp {
+		result = append(result, FuncTypeUDP)
+	}
+	return result
+}
+
+// sortPorts sorts ports in numerical order
+func sortPorts(ports []FuncPort) {
+	sort.Slice(ports, func(i, j int) bool {
+		a, _ := strconv.Atoi(string(ports[i]))
+		b, _ := strconv.Atoi(string(ports[j]))
+		return a < b
+	})
+}
+
+func sortedPorts(funcPort ExternalFuncPort) []FuncPort {
+	ports := make([]FuncPort, 0, len(funcPort))
+	for port := range funcPort {
+		ports = append(ports, port)
+	}
+	sortPorts(ports)
+	return ports
+}
+
 func generateK8sNetPolicy(cli *cli.Context) {
 	tree := GetExternalFuncTree()
 
@@ -50,31 +95,77 @@ func generateK8sNetPolicy(cli *cli.Context) {
 		log.Fatalf("Unable to read template file: %s", err)
 	}
 
-	format := "{\n  \"podSelector\": {\n    \"matchLabels\": {\n"
-	format += "      \"apisim\": \"%s\"\n    }\n  }\n}"
+	format := "          {\n            \"podSelector\": {\n              \"matchLabels\": {\n"
+	format += "                \"apisim\": \"%s\"\n              }\n            }\n          }"
+	portFormat := "          {\"protocol\": \"%s\", \"port\": %s}"
 
-	for host, funcNode := range tree {
-		// status can reach all functions
-		policyText := fmt.Sprintf(format, "status")
+	for host, funcPort := range tree {
+		policyText := ""
+
+		for _, port := range sortedPorts(funcPort) {
+			// status can reach all functions
+			from := fmt.Sprintf(format, "status")
 
-		for port := range funcNode {
 			callers := FindCallers(host, port)
 			l4callers := callers.L4Callers()
 
 			for k := range l4callers {
-				policyText += "," + fmt.Sprintf(format, k)
+				from += ",\n" + fmt.Sprintf(format, k)
+			}
+
+			ports := ""
+			for i, proto := range portProtocols(funcPort[port]) {
+				if i > 0 {
+					ports += ",\n"
+				}
+				ports += fmt.Sprintf(portFormat, proto, port)
 			}
+
+			if policyText != "" {
+				policyText += ",\n"
+			}
+			policyText += fmt.Sprintf("      {\n        \"from\": [\n%s\n        ],\n        \"ports\": [\n%s\n        ]\n      }", from, ports)
 		}
 
-		c := PolicyTemplate{host, policyText}
+		egressText := ""
+		if policyEgress {
+			for _, rule := range egressRules(host) {
+				out, _ := json.MarshalIndent(rule, "      ", "  ")
+				if egressText != "" {
+					egressText += ",\n"
+				}
+				egressText += "      " + string(out)
+			}
+		}
+
+		c := PolicyTemplate{host, policyText, egressText}
 		writeSpec(policyTmpl, c, string(host)+"_netpolicy.spec", "NetPolicy")
 	}
 }
 
 type TemplateConfig struct {
-	Name    FuncHost
-	Ports   string
-	Command string
+	Name     FuncHost
+	Ports    string
+	Command  string
+	Replicas int
+	Labels   string
+}
+
+func formatLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	result := ""
+	for _, k := range keys {
+		key, _ := json.Marshal(k)
+		value, _ := json.Marshal(labels[k])
+		result += fmt.Sprintf(",\n\t\t    %s: %s", key, value)
+	}
+
+	return result
 }
 
 func generateK8sSpec(cli *cli.Context) {
@@ -93,30 +184,47 @@ func generateK8sSpec(cli *cli.Context) {
 	for host, nodeFunc := range tree {
 		ports := ""
 		nports := 0
-		for port := range nodeFunc {
-			if nports > 0 {
-				ports += ","
+		for _, port := range sortedPorts(nodeFunc) {
+			for _, proto := range portProtocols(nodeFunc[port]) {
+				if nports > 0 {
+					ports += ","
+				}
+				f := "{\"containerPort\": %s, \"protocol\": \"%s\", \"name\": \"%s\"}"
+				ports += fmt.Sprintf(f, string(port), proto, portName(port, proto))
+				nports++
 			}
-			f := "{\"containerPort\": %s, \"name\": \"apisim-%s\"}"
-			ports += fmt.Sprintf(f, string(port), string(port))
-			nports++
 		}
 
-		c := TemplateConfig{host, ports, "\"/go/bin/app\", \"node-server\""}
+		attrs := GetHostAttrs(host)
+		command := fmt.Sprintf("\"/go/bin/app\", \"node-server\", \"-n\", \"%s\"", host)
+		c := TemplateConfig{host, ports, command, attrs.Replicas, formatLabels(attrs.Labels)}
 		writeSpec(rcTmpl, c, string(host)+"_rc.spec", "ReplicationController")
 
 		ports = ""
 		nports = 0
-		for port := range nodeFunc {
-			if nports > 0 {
-				ports += ","
+		for _, port := range sortedPorts(nodeFunc) {
+			for _, proto := range portProtocols(nodeFunc[port]) {
+				if nports > 0 {
+					ports += ","
+				}
+				f := "{\"port\": %s, \"protocol\": \"%s\", \"targetPort\": \"%s\", \"name\": \"%s\"}"
+				name := portName(port, proto)
+				ports += fmt.Sprintf(f, string(port), proto, name, name)
+				nports++
 			}
-			f := "{\"port\": %s, \"targetPort\": \"apisim-%s\"}"
-			ports += fmt.Sprintf(f, string(port), string(port))
-			nports++
 		}
 
-		c = TemplateConfig{host, ports, ""}
+		c = TemplateConfig{host, ports, "", 0, ""}
 		writeSpec(svcTmpl, c, string(host)+"_svc.spec", "Service")
 	}
 }
+
+// portName returns the name of a container port. UDP ports are suffixed to
+// keep the name unique if the same port is also used over TCP, names are
+// limited to 15 characters.
+func portName(port FuncPort, proto string) string {
+	if proto == FuncTypeUDP {
+		return "apisim-" + string(port) + "u"
+	}
+	return "apisim-" + string(port)
+}
@@ -22,6 +22,35 @@ type L7Template struct {
 	Policy string
 }
 
+// l7Rule returns the policy rule matching calls to hf. Route patterns are
+// converted to regular expressions, query and header constraints are
+// carried over as is. Topic calls map to Kafka-style produce and consume
+// rules on the topic.
+func l7Rule(hf FuncHttp) string {
+	switch hf.method {
+	case FuncTypePublish:
+		return fmt.Sprintf("produce topic=%s %s:%s", hf.Topic(), hf.host, hf.port)
+	case FuncTypeSubscribe:
+		return fmt.Sprintf("consume topic=%s %s:%s", hf.Topic(), hf.host, hf.port)
+	}
+
+	uri := hf.RequestURI()
+	if IsRoutePattern(hf.path) {
+		uri = fmt.Sprintf("%s:%s%s", hf.host, hf.port, RouteRegex(hf.path))
+		if hf.query != "" {
+			uri += "?" + hf.query
+		}
+	}
+
+	method, _ := hf.WireRequest()
+	rule := fmt.Sprintf("%s %s", method, uri)
+	if hf.headers != "" {
+		rule += " " + hf.headers
+	}
+
+	return rule
+}
+
 func writeL7Policy(host FuncHost, port FuncPort, node ExternalFuncNode) {
 	policyTmpl, err := template.ParseFiles("templates/l7_policy.json")
 	if err != nil {
@@ -35,10 +64,14 @@ func writeL7Policy(host FuncHost, port FuncPort, node ExternalFuncNode) {
 			switch call.(type) {
 			case FuncHttp:
 				hf := call.(FuncHttp)
+				if hf.IsSocket() {
+					// only L4 policy applies to TCP and UDP
+					continue
+				}
 				if ncalls > 0 {
 					policyText += ",\n"
 				}
-				policyText += fmt.Sprintf("\t\t{%s %s}", hf.method, hf.uri)
+				policyText += fmt.Sprintf("\t\t{%s}", l7Rule(hf))
 				ncalls++
 			}
 		}
@@ -49,13 +82,13 @@ func writeL7Policy(host FuncHost, port FuncPort, node ExternalFuncNode) {
 	log.Infof("Generating L7 Policy %s...", path)
 	policySpec, err := os.Create(path)
 	if err != nil {
-		log.Fatal("Unable to open spec file \"%s\" for writing: %s", path, err)
+		log.Fatalf("Unable to open spec file \"%s\" for writing: %s", path, err)
 	}
 
 	defer policySpec.Close()
 
 	if err := policyTmpl.Execute(policySpec, tmpl); err != nil {
-		log.Fatal("Unable to write spec file: %s", err)
+		log.Fatalf("Unable to write spec file: %s", err)
 	}
 }
 
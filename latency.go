@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Duration is a time.Duration which is represented as a string such as
+// "150ms" in the definition file.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"10ms\": %s", err)
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+const (
+	LatencyFixed      = "fixed"
+	LatencyUniform    = "uniform"
+	LatencyNormal     = "normal"
+	LatencyPercentile = "percentile"
+)
+
+type percentilePoint struct {
+	p float64
+	d time.Duration
+}
+
+// Latency describes the distribution of the simulated processing time of a
+// function. Depending on Type, the following fields are used:
+//
+//	fixed:      Value
+//	uniform:    Min, Max
+//	normal:     Mean, StdDev
+//	percentile: Percentiles, e.g. {"50": "10ms", "99": "250ms"}
+type Latency struct {
+	Type        string              `json:"Type" yaml:"Type"`
+	Value       Duration            `json:"Value,omitempty" yaml:"Value,omitempty"`
+	Min         Duration            `json:"Min,omitempty" yaml:"Min,omitempty"`
+	Max         Duration            `json:"Max,omitempty" yaml:"Max,omitempty"`
+	Mean        Duration            `json:"Mean,omitempty" yaml:"Mean,omitempty"`
+	StdDev      Duration            `json:"StdDev,omitempty" yaml:"StdDev,omitempty"`
+	Percentiles map[string]Duration `json:"Percentiles,omitempty" yaml:"Percentiles,omitempty"`
+
+	table []percentilePoint
+}
+
+// Validate checks the distribution parameters and prepares the percentile
+// table for sampling.
+func (l *Latency) Validate() error {
+	switch l.Type {
+	case LatencyFixed:
+		if l.Value < 0 {
+			return fmt.Errorf("fixed latency must not be negative")
+		}
+	case LatencyUniform:
+		if l.Min < 0 || l.Max < l.Min {
+			return fmt.Errorf("uniform latency requires 0 <= Min <= Max")
+		}
+	case LatencyNormal:
+		if l.Mean < 0 || l.StdDev < 0 {
+			return fmt.Errorf("normal latency requires non-negative Mean and StdDev")
+		}
+	case LatencyPercentile:
+		if len(l.Percentiles) == 0 {
+			return fmt.Errorf("percentile latency requires at least one percentile")
+		}
+
+		l.table = make([]percentilePoint, 0, len(l.Percentiles))
+		for k, d := range l.Percentiles {
+			p, err := strconv.ParseFloat(k, 64)
+			if err != nil || p <= 0 || p > 100 {
+				return fmt.Errorf("invalid percentile \"%s\", must be in (0, 100]", k)
+			}
+			l.table = append(l.table, percentilePoint{p, time.Duration(d)})
+		}
+
+		sort.Slice(l.table, func(i, j int) bool { return l.table[i].p < l.table[j].p })
+		for i := 1; i < len(l.table); i++ {
+			if l.table[i].p == l.table[i-1].p {
+				return fmt.Errorf("percentile %v is given more than once", l.table[i].p)
+			}
+			if l.table[i].d < l.table[i-1].d {
+				return fmt.Errorf("percentile %v is lower than percentile %v",
+					l.table[i].p, l.table[i-1].p)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown latency type \"%s\"", l.Type)
+	}
+
+	return nil
+}
+
+// Sample returns a random delay drawn from the distribution. A nil Latency
+// never delays.
+func (l *Latency) Sample() time.Duration {
+	if l == nil {
+		return 0
+	}
+
+	switch l.Type {
+	case LatencyFixed:
+		return time.Duration(l.Value)
+	case LatencyUniform:
+		spread := int64(l.Max - l.Min)
+		if spread == 0 {
+			return time.Duration(l.Min)
+		}
+		return time.Duration(int64(l.Min) + rand.Int63n(spread+1))
+	case LatencyNormal:
+		d := float64(l.Mean) + rand.NormFloat64()*float64(l.StdDev)
+		if d < 0 {
+			return 0
+		}
+		return time.Duration(d)
+	case LatencyPercentile:
+		return l.samplePercentile(rand.Float64() * 100)
+	}
+
+	return 0
+}
+
+// samplePercentile interpolates linearly between the two points of the
+// percentile table surrounding p. Values beyond the highest percentile are
+// capped at its latency.
+func (l *Latency) samplePercentile(p float64) time.Duration {
+	prev := percentilePoint{0, 0}
+	for _, point := range l.table {
+		if p <= point.p {
+			frac := (p - prev.p) / (point.p - prev.p)
+			return prev.d + time.Duration(frac*float64(point.d-prev.d))
+		}
+		prev = point
+	}
+
+	return prev.d
+}
+
+// SimulateLatency blocks for a delay drawn from the latency distribution
+// of the function, if one is defined.
+func SimulateLatency(def FuncDef) {
+	if d := definitionTree.Latency[def].Sample(); d > 0 {
+		log.Infof("Function %+v delaying response by %s", def, d)
+		time.Sleep(d)
+	}
+}
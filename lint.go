@@ -0,0 +1,415 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	lintEntries cli.StringSlice
+
+	LintCommand = cli.Command{
+		Name:     "lint",
+		Usage:    "Checks the definition for unreachable functions, call cycles and port conflicts",
+		Category: "Definition",
+		Action:   runLint,
+		Flags: []cli.Flag{
+			cli.StringSliceFlag{
+				Value: &lintEntries,
+				Name:  "e, entry",
+				Usage: "Function called from outside the definition, defaults to all functions making calls without being called",
+			},
+		},
+	}
+)
+
+const (
+	LintError   = "Error"
+	LintWarning = "Warning"
+)
+
+// lintFinding is a problem found in the definition. It is located at the
+// key of a function or, if given, at a call made by that function.
+type lintFinding struct {
+	Level string
+	Key   string
+	Call  string
+	Msg   string
+
+	offset int
+}
+
+// lintSource maps the canonical names of functions to the position of
+// their key in the definition file and their calls to the text they are
+// written as.
+type lintSource struct {
+	file    string
+	content []byte
+	keys    map[string][]int
+	calls   map[string]map[string]string
+}
+
+func newLintSource(file string) (*lintSource, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var pt funcTreeSpec
+	switch filepath.Ext(file) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &pt)
+	default:
+		err = json.Unmarshal(content, &pt)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	src := &lintSource{
+		file:    file,
+		content: content,
+		keys:    make(map[string][]int),
+		calls:   make(map[string]map[string]string),
+	}
+	for key, spec := range pt.Funcs {
+		def, err := ParseFuncDef(key)
+		if err != nil {
+			return nil, err
+		}
+		re := regexp.MustCompile(`(?m)(?:^[ \t]*|["'])(` + regexp.QuoteMeta(key) + `)["']?[ \t]*:`)
+		if m := re.FindSubmatchIndex(content); m != nil {
+			src.keys[def.String()] = m[2:4]
+		}
+		src.calls[def.String()] = make(map[string]string)
+
+		if spec == nil {
+			continue
+		}
+		for _, call := range spec.Calls {
+			if callDef, err := ParseFuncDef(call.Call); err == nil {
+				src.calls[def.String()][callDef.String()] = call.Call
+			}
+		}
+	}
+
+	return src, nil
+}
+
+// offset returns the position of the finding in the definition file or -1
+func (s *lintSource) offset(l lintFinding) int {
+	m, ok := s.keys[l.Key]
+	if !ok {
+		return -1
+	}
+
+	if call, ok := s.calls[l.Key][l.Call]; ok {
+		if i := strings.Index(string(s.content[m[1]:]), call); i >= 0 {
+			return m[1] + i
+		}
+	}
+
+	return m[0]
+}
+
+// Format returns the finding with the line of the definition it refers to
+func (s *lintSource) Format(l lintFinding) string {
+	off := l.offset
+	if off < 0 {
+		return fmt.Sprintf("%s: %s: %s", l.Level, path.Base(s.file), l.Msg)
+	}
+
+	line, ctx, col := getContext(s.content, int64(off))
+	pre := []byte(ctx[:col])
+	for i := range pre {
+		if pre[i] != '\t' {
+			pre[i] = ' '
+		}
+	}
+
+	return fmt.Sprintf("%s: %s:%d: %s:\n%s\n%s^", l.Level, path.Base(s.file), line, l.Msg, ctx, pre)
+}
+
+// lintGraph returns the names of all functions and the functions each of
+// them references by HTTP or CALL.
+func lintGraph() ([]string, map[string][]string) {
+	var names []string
+	edges := make(map[string][]string)
+
+	for key, calls := range definitionTree.Funcs {
+		names = append(names, key.String())
+		for _, call := range calls {
+			if call.IsReference() {
+				edges[key.String()] = append(edges[key.String()], call.String())
+			}
+		}
+	}
+
+	sort.Strings(names)
+	for _, targets := range edges {
+		sort.Strings(targets)
+	}
+	return names, edges
+}
+
+// lintCycles reports every call cycle once, at the call closing the cycle.
+// The FuncStack header works around cycles at runtime, so they are warnings.
+func lintCycles(names []string, edges map[string][]string) []lintFinding {
+	var findings []lintFinding
+	state := make(map[string]int)
+	var stack []string
+
+	var visit func(name string)
+	visit = func(name string) {
+		state[name] = 1
+		stack = append(stack, name)
+
+		for _, next := range edges[name] {
+			switch state[next] {
+			case 0:
+				visit(next)
+			case 1:
+				i := len(stack) - 1
+				for stack[i] != next {
+					i--
+				}
+				cycle := append(append([]string{}, stack[i:]...), next)
+				findings = append(findings, lintFinding{
+					Level: LintWarning,
+					Key:   name,
+					Call:  next,
+					Msg:   "call cycle " + strings.Join(cycle, " -> "),
+				})
+			}
+		}
+
+		stack = stack[:len(stack)-1]
+		state[name] = 2
+	}
+
+	for _, name := range names {
+		if state[name] == 0 {
+			visit(name)
+		}
+	}
+
+	return findings
+}
+
+// lintUnreachable reports functions that cannot be reached from an entry
+// point. Unless given, the entry points are the functions making calls
+// that are not called by any function outside of their own call cycle.
+func lintUnreachable(names []string, edges map[string][]string) []lintFinding {
+	reach := make(map[string]map[string]bool)
+	var visit func(from string, name string)
+	visit = func(from string, name string) {
+		for _, next := range edges[name] {
+			if !reach[from][next] {
+				reach[from][next] = true
+				visit(from, next)
+			}
+		}
+	}
+	for _, name := range names {
+		reach[name] = make(map[string]bool)
+		visit(name, name)
+	}
+
+	var entries []string
+	if len(lintEntries) > 0 {
+		for _, e := range lintEntries {
+			def, err := ParseFuncDef(e)
+			if err != nil {
+				log.Fatalf("Invalid entry \"%s\": %s", e, err)
+			}
+			if _, ok := definitionTree.Funcs[def]; !ok {
+				log.Fatalf("Entry \"%s\" is not defined", e)
+			}
+			entries = append(entries, def.String())
+		}
+	} else {
+		for _, name := range names {
+			entry := len(edges[name]) > 0
+			for _, other := range names {
+				if reach[other][name] && !reach[name][other] {
+					entry = false
+				}
+			}
+			if entry {
+				entries = append(entries, name)
+			}
+		}
+	}
+
+	reached := make(map[string]bool)
+	for _, e := range entries {
+		reached[e] = true
+		for name := range reach[e] {
+			reached[name] = true
+		}
+	}
+
+	var findings []lintFinding
+	for key := range definitionTree.Funcs {
+		name := key.String()
+		if _, ok := key.(FuncHttp); ok && !reached[name] {
+			findings = append(findings, lintFinding{
+				Level: LintWarning,
+				Key:   name,
+				Msg:   fmt.Sprintf("function \"%s\" is unreachable", name),
+			})
+		}
+	}
+	return findings
+}
+
+// lintUnserved reports functions not served by any host. CALL functions
+// only run when referenced from a function a host serves, DATA keys never
+// run.
+func lintUnserved(edges map[string][]string) []lintFinding {
+	called := make(map[string]bool)
+	var visit func(name string)
+	visit = func(name string) {
+		for _, next := range edges[name] {
+			if !called[next] {
+				called[next] = true
+				visit(next)
+			}
+		}
+	}
+	for key := range definitionTree.Funcs {
+		if _, ok := key.(FuncHttp); ok {
+			visit(key.String())
+		}
+	}
+
+	var findings []lintFinding
+	for key := range definitionTree.Funcs {
+		switch key.(type) {
+		case FuncData:
+			findings = append(findings, lintFinding{
+				Level: LintError,
+				Key:   key.String(),
+				Msg:   fmt.Sprintf("\"%s\" is not served by any host, DATA can only be returned by a call", key),
+			})
+		case FuncCall:
+			if !called[key.String()] {
+				findings = append(findings, lintFinding{
+					Level: LintError,
+					Key:   key.String(),
+					Msg:   fmt.Sprintf("\"%s\" is not served by any host nor called by a function that is", key),
+				})
+			}
+		}
+	}
+	return findings
+}
+
+// lintPorts reports ports of a host written in different ways, TCP sockets
+// sharing a port with the HTTP listeners of the host and hosts without any
+// function on the function port.
+func lintPorts() []lintFinding {
+	var findings []lintFinding
+	funcPort := FuncPort(strconv.Itoa(ConfigFuncPort))
+
+	for host, ports := range GetExternalFuncTree() {
+		listeners := make(map[FuncPort]bool)
+		for _, port := range nodePorts(string(host)) {
+			listeners[port] = true
+		}
+
+		numbers := make(map[int]FuncPort)
+		for _, port := range sortedPorts(ports) {
+			n := portNumber(port)
+			if other, ok := numbers[n]; ok {
+				findings = append(findings, lintFinding{
+					Level: LintError,
+					Key:   lintKeyOn(host, port),
+					Msg:   fmt.Sprintf("port %s of host %s duplicates port %s", port, host, other),
+				})
+			}
+			numbers[n] = port
+
+			for node := range ports[port] {
+				if node.method == FuncTypeTCP && listeners[port] {
+					socket, _ := NewFuncSocket(node.method, string(host)+":"+string(port))
+					findings = append(findings, lintFinding{
+						Level: LintError,
+						Key:   socket.String(),
+						Msg:   fmt.Sprintf("TCP socket on %s:%s conflicts with the HTTP listener of the host", host, port),
+					})
+				}
+			}
+		}
+
+		if _, ok := ports[funcPort]; !ok {
+			findings = append(findings, lintFinding{
+				Level: LintWarning,
+				Key:   lintKeyOn(host, ""),
+				Msg:   fmt.Sprintf("host %s has no function listening on --func-port %s", host, funcPort),
+			})
+		}
+	}
+	return findings
+}
+
+// lintKeyOn returns the first function of host on port, any port if empty
+func lintKeyOn(host FuncHost, port FuncPort) string {
+	var names []string
+	for key := range definitionTree.Funcs {
+		if hf, ok := key.(FuncHttp); ok && hf.host == host && (port == "" || hf.port == port) {
+			names = append(names, key.String())
+		}
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		return ""
+	}
+	return names[0]
+}
+
+func runLint(cli *cli.Context) {
+	src, err := newLintSource(configFile)
+	if err != nil {
+		log.Fatalf("Unable to read definition: %s", err)
+	}
+
+	names, edges := lintGraph()
+
+	var findings []lintFinding
+	findings = append(findings, lintCycles(names, edges)...)
+	findings = append(findings, lintUnserved(edges)...)
+	findings = append(findings, lintPorts()...)
+	findings = append(findings, lintUnreachable(names, edges)...)
+
+	for i := range findings {
+		findings[i].offset = src.offset(findings[i])
+	}
+	sort.SliceStable(findings, func(i, j int) bool {
+		return findings[i].offset < findings[j].offset
+	})
+
+	errors := 0
+	for _, l := range findings {
+		fmt.Println(src.Format(l))
+		if l.Level == LintError {
+			errors++
+		}
+	}
+
+	fmt.Printf("%d errors, %d warnings\n", errors, len(findings)-errors)
+	if errors > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// Payload is the data returned by a function. The data is either given
+// inline as a JSON value, read from a file or generated as a random blob of
+// the given size. Files and all strings of inline values are expanded as
+// Go text/template with a PayloadContext.
+type Payload struct {
+	Inline json.RawMessage `json:"Inline,omitempty" yaml:"-"`
+	File   string          `json:"File,omitempty" yaml:"File"`
+	Random int             `json:"Random,omitempty" yaml:"Random"`
+
+	// inline mirrors the inline value with all strings replaced by
+	// their parsed templates
+	inline interface{}
+	tmpl   *template.Template
+}
+
+// PayloadContext is the data available to payload templates
+type PayloadContext struct {
+	Function string
+	Method   string
+	Host     string
+	Path     string
+	Query    url.Values
+	Params   RouteParams
+	Headers  http.Header
+	Stack    []string
+}
+
+func NewPayloadContext(req *http.Request, def FuncDef) *PayloadContext {
+	return &PayloadContext{
+		Function: def.String(),
+		Method:   req.Method,
+		Host:     req.Host,
+		Path:     req.URL.Path,
+		Query:    req.URL.Query(),
+		Params:   GetRouteParams(req),
+		Headers:  req.Header,
+		Stack:    req.Header[FuncStackHeader],
+	}
+}
+
+var payloadFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		out, err := json.Marshal(v)
+		return string(out), err
+	},
+	"join": strings.Join,
+}
+
+// compile validates the payload and parses its template. Relative file
+// names are resolved against baseDir.
+func (p *Payload) compile(baseDir string) error {
+	sources := 0
+
+	if len(p.Inline) > 0 {
+		var value interface{}
+		if err := json.Unmarshal(p.Inline, &value); err != nil {
+			return err
+		} else if value == nil {
+			return fmt.Errorf("inline payload must not be null")
+		}
+
+		inline, err := compileInline(value)
+		if err != nil {
+			return err
+		}
+		p.inline = inline
+		sources++
+	}
+
+	if p.File != "" {
+		if !filepath.IsAbs(p.File) {
+			p.File = filepath.Join(baseDir, p.File)
+		}
+
+		content, err := ioutil.ReadFile(p.File)
+		if err != nil {
+			return err
+		}
+
+		tmpl, err := newPayloadTemplate(string(content))
+		if err != nil {
+			return err
+		}
+		p.tmpl = tmpl
+		sources++
+	}
+
+	if p.Random < 0 {
+		return fmt.Errorf("invalid random payload size %d", p.Random)
+	} else if p.Random > 0 {
+		sources++
+	}
+
+	if sources != 1 {
+		return fmt.Errorf("payload requires exactly one of Inline, File or Random")
+	}
+
+	return nil
+}
+
+func newPayloadTemplate(text string) (*template.Template, error) {
+	return template.New("payload").Funcs(payloadFuncs).Option("missingkey=zero").Parse(text)
+}
+
+func compileInline(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return newPayloadTemplate(v)
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i := range v {
+			elem, err := compileInline(v[i])
+			if err != nil {
+				return nil, err
+			}
+			result[i] = elem
+		}
+		return result, nil
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for k := range v {
+			elem, err := compileInline(v[k])
+			if err != nil {
+				return nil, err
+			}
+			result[k] = elem
+		}
+		return result, nil
+	default:
+		return v, nil
+	}
+}
+
+func renderInline(value interface{}, ctx *PayloadContext) (interface{}, error) {
+	switch v := value.(type) {
+	case *template.Template:
+		buf := new(bytes.Buffer)
+		if err := v.Execute(buf, ctx); err != nil {
+			return nil, err
+		}
+		return buf.String(), nil
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i := range v {
+			elem, err := renderInline(v[i], ctx)
+			if err != nil {
+				return nil, err
+			}
+			result[i] = elem
+		}
+		return result, nil
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for k := range v {
+			elem, err := renderInline(v[k], ctx)
+			if err != nil {
+				return nil, err
+			}
+			result[k] = elem
+		}
+		return result, nil
+	default:
+		return v, nil
+	}
+}
+
+const randomAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// randomIntn is the source of random payloads
+var randomIntn = rand.Intn
+
+func randomString(n int) string {
+	buf := make([]byte, n)
+	for i := range buf {
+		buf[i] = randomAlphabet[randomIntn(len(randomAlphabet))]
+	}
+	return string(buf)
+}
+
+// RenderBytes returns the expanded payload as raw bytes
+func (p *Payload) RenderBytes(ctx *PayloadContext) ([]byte, error) {
+	if p.inline != nil {
+		value, err := renderInline(p.inline, ctx)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(value)
+	} else if p.Random > 0 {
+		return []byte(randomString(p.Random)), nil
+	}
+
+	buf := new(bytes.Buffer)
+	if err := p.tmpl.Execute(buf, ctx); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Render returns the payload as JSON value. Random blobs and files which do
+// not expand to valid JSON are returned as JSON string, random blobs even
+// if they happen to be valid JSON.
+func (p *Payload) Render(ctx *PayloadContext) (json.RawMessage, error) {
+	if p == nil {
+		return nil, nil
+	}
+
+	text, err := p.RenderBytes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.Random == 0 && json.Valid(text) {
+		return text, nil
+	}
+
+	return json.Marshal(string(text))
+}
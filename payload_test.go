@@ -0,0 +1,24 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRenderRandomDigits(t *testing.T) {
+	defer func(f func(int) int) { randomIntn = f }(randomIntn)
+	randomIntn = func(n int) int { return strings.IndexByte(randomAlphabet, '7') }
+
+	p := &Payload{Random: 3}
+	if err := p.compile(""); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := p.Render(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `"777"` {
+		t.Errorf("random payload rendered as %s, expected \"777\"", data)
+	}
+}
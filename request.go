@@ -2,41 +2,167 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"strconv"
 	"time"
 )
 
 type HeaderChangeFunc func(f FuncHttp, inReq *http.Request, outReq *http.Request)
 
 func doRequest(ownFunc FuncDef, f FuncHttp, inReq *http.Request, readBody bool,
-	hdrFunc HeaderChangeFunc, timeout time.Duration) string {
+	hdrFunc HeaderChangeFunc, timeout time.Duration) *CallResult {
 	client := &http.Client{
 		Timeout: timeout,
 	}
 
-	key := JSON(fmt.Sprintf("%s %s", f.method, f.uri))
-	url := fmt.Sprintf("http://%s", f.uri)
-	outReq, err := http.NewRequest(f.method, url, nil)
+	if f.IsSocket() {
+		return socketRequest(ownFunc, f, inReq, readBody, timeout)
+	}
+
+	result := NewCallResult(f.String())
+
+	var data []byte
+	contentType := ""
+	if f.body != nil {
+		var err error
+		data, err = f.body.Payload.RenderBytes(NewPayloadContext(inReq, f))
+		if err != nil {
+			result.Error = fmt.Sprintf("unable to render request body: %s", err)
+			return result
+		}
+		contentType = f.body.ContentType
+	} else if msg := GetTopicMessage(inReq); msg != nil && f.method == FuncTypeSubscribe {
+		// The broker delivers the published message to subscribers
+		data, contentType = msg.Data, msg.ContentType
+	}
+
+	uri := f.RequestURI()
+	if IsRoutePattern(f.path) {
+		uri = string(f.host) + ":" + string(f.port) + ExpandRoute(f.path, GetRouteParams(inReq))
+		if f.query != "" {
+			uri += "?" + f.query
+		}
+	}
+
+	var outReq *http.Request
+	var err error
+
+	scheme := "http"
+	if TLSEnabled {
+		scheme = "https"
+		if client.Transport, err = clientTransport(GetIdentity(inReq), f.IsGrpc()); err != nil {
+			result.Error = err.Error()
+			return result
+		}
+	} else if f.IsGrpc() {
+		client.Transport = grpcTransport
+	} else {
+		client.Transport = httpTransport
+	}
+
+	url := fmt.Sprintf("%s://%s", scheme, uri)
+	if f.IsGrpc() {
+		outReq, err = NewGrpcRequest(url, data)
+	} else {
+		var reqBody io.Reader
+		if contentType != "" {
+			reqBody = bytes.NewReader(data)
+		}
+		outReq, err = http.NewRequest(f.method, url, reqBody)
+	}
 	if err != nil {
-		return fmt.Sprintf("{%s: %s}", ErrorReport(err))
+		result.Error = err.Error()
+		return result
+	}
+
+	if contentType != "" && !f.IsGrpc() {
+		outReq.Header.Set("Content-Type", contentType)
+	}
+
+	for name, values := range f.HeaderConstraints() {
+		for _, v := range values {
+			outReq.Header.Add(name, v)
+		}
 	}
 
 	hdrFunc(f, inReq, outReq)
 
+	start := time.Now()
 	resp, err := client.Do(outReq)
 	if err != nil {
-		return fmt.Sprintf("{%s: %s}", key, ErrorReport(err))
+		result.Latency = Duration(time.Since(start))
+		result.Error = err.Error()
+		return result
+	}
+	defer resp.Body.Close()
+
+	var body []byte
+	var callErr error
+	status := resp.StatusCode
+	if readBody && f.IsGrpc() && resp.StatusCode == http.StatusOK {
+		var code int
+		body, code, callErr = ReadGrpcResponse(resp)
+		status = httpStatusFromGrpc(code)
 	} else if readBody {
-		buf := new(bytes.Buffer)
-		buf.ReadFrom(resp.Body)
-		return fmt.Sprintf("{%s: %s}", key, buf.String())
-	} else {
-		if IsCaller(ownFunc, f) {
-			return fmt.Sprintf("{%s: %s}", key, JSON("OK"))
-		} else {
-			return fmt.Sprintf("{%s: %s}", key, JSON("VULN"))
+		body, err = ioutil.ReadAll(resp.Body)
+	}
+	latency := Duration(time.Since(start))
+
+	if err != nil {
+		result.Error = err.Error()
+	} else if readBody && len(body) > 0 {
+		// The callee reports its own subtree, add what was observed
+		// from the outside.
+		if err := json.Unmarshal(body, result); err != nil {
+			result.Error = fmt.Sprintf("invalid response: %s", err)
+		}
+		result.Function = f.String()
+	}
+
+	if resp.TLS != nil {
+		// The callee reports the client identity it has seen
+		info := sessionInfo(resp.TLS)
+		if result.TLS != nil {
+			info.Client = result.TLS.Client
+		}
+		info.Server = peerIdentity(resp.TLS)
+		result.TLS = info
+	}
+
+	if callErr != nil && result.Error == "" {
+		result.Error = callErr.Error()
+	}
+
+	result.Status = status
+	result.Latency = latency
+
+	if status >= 400 {
+		if result.Error == "" {
+			result.Error = resp.Status
 		}
+	} else {
+		setVerdict(result, ownFunc, f, inReq, readBody)
+	}
+
+	return result
+}
+
+// setVerdict judges successful pings and exploit attempts against the calls
+// the calling function is supposed to make.
+func setVerdict(result *CallResult, ownFunc FuncDef, f FuncHttp, inReq *http.Request, readBody bool) {
+	if result.Error != "" || ownFunc == FuncDef(FuncHttp{}) ||
+		(readBody && inReq.Header.Get("Exploit") == "") {
+		return
+	}
+
+	if IsCaller(ownFunc, f) {
+		result.Verdict = VerdictOK
+	} else {
+		result.Verdict = VerdictVuln
 	}
 }
 
@@ -44,13 +170,24 @@ func pingHeader(f FuncHttp, inReq *http.Request, outReq *http.Request) {
 	outReq.Header.Set("NoOperation", "True")
 }
 
-func PingRequest(ownFunc FuncDef, f FuncHttp, inReq *http.Request) string {
+func PingRequest(ownFunc FuncDef, f FuncHttp, inReq *http.Request) *CallResult {
 	return doRequest(ownFunc, f, inReq, false, pingHeader, Timeout)
 }
 
+// requestHeader passes the exploit mode and function stack on to the callee.
+// An ExploitDepth header limits how many levels of callees are exploited,
+// the callees of the last level are only pinged to probe reachability.
 func requestHeader(f FuncHttp, inReq *http.Request, outReq *http.Request) {
 	if inReq.Header.Get("Exploit") != "" {
-		outReq.Header.Set("Exploit", "True")
+		depth := inReq.Header.Get("ExploitDepth")
+		if n, err := strconv.Atoi(depth); depth == "" {
+			outReq.Header.Set("Exploit", "True")
+		} else if err == nil && n > 1 {
+			outReq.Header.Set("Exploit", "True")
+			outReq.Header.Set("ExploitDepth", strconv.Itoa(n-1))
+		} else {
+			outReq.Header.Set("NoOperation", "True")
+		}
 	}
 
 	hdrList, _ := inReq.Header[FuncStackHeader]
@@ -58,7 +195,7 @@ func requestHeader(f FuncHttp, inReq *http.Request, outReq *http.Request) {
 	outReq.Header[FuncStackHeader] = hdrList
 }
 
-func HttpRequest(ownFunc FuncDef, f FuncHttp, inReq *http.Request) string {
+func HttpRequest(ownFunc FuncDef, f FuncHttp, inReq *http.Request) *CallResult {
 	return doRequest(ownFunc, f, inReq, true, requestHeader, Timeout*4)
 }
 
@@ -66,6 +203,6 @@ func neighborHeader(f FuncHttp, inReq *http.Request, outReq *http.Request) {
 	outReq.Header.Set("NeighborConnectivity", "True")
 }
 
-func NeighborRequest(ownFunc FuncDef, f FuncHttp, inReq *http.Request) string {
+func NeighborRequest(ownFunc FuncDef, f FuncHttp, inReq *http.Request) *CallResult {
 	return doRequest(ownFunc, f, inReq, true, neighborHeader, Timeout*4)
 }
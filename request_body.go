@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// FuncCallSpec is a single entry in the list of calls of a function. It is
+// either given as the plain name of the called function or as an object
+// which additionally describes the request body sent along with the call.
+type FuncCallSpec struct {
+	Call        string          `json:"Call" yaml:"Call"`
+	Body        json.RawMessage `json:"Body,omitempty" yaml:"-"`
+	Payload     *Payload        `json:"Payload,omitempty" yaml:"Payload"`
+	ContentType string          `json:"ContentType,omitempty" yaml:"ContentType"`
+}
+
+func (s *FuncCallSpec) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &s.Call); err == nil {
+		return nil
+	}
+
+	type plain FuncCallSpec
+	return json.Unmarshal(data, (*plain)(s))
+}
+
+// requestBody returns the body to send along with the call or nil if the
+// call has no body.
+func (s *FuncCallSpec) requestBody(baseDir string) (*RequestBody, error) {
+	payload := s.Payload
+	if len(s.Body) > 0 {
+		if payload != nil {
+			return nil, fmt.Errorf("call has both Body and Payload")
+		}
+		payload = &Payload{Inline: s.Body}
+	}
+
+	if payload == nil {
+		if s.ContentType != "" {
+			return nil, fmt.Errorf("call has a ContentType but no body")
+		}
+		return nil, nil
+	}
+
+	if err := payload.compile(baseDir); err != nil {
+		return nil, err
+	}
+
+	body := &RequestBody{
+		ContentType: s.ContentType,
+		Payload:     payload,
+	}
+
+	if body.ContentType == "" {
+		switch {
+		case payload.inline != nil:
+			body.ContentType = "application/json"
+		case payload.File != "":
+			body.ContentType = mime.TypeByExtension(filepath.Ext(payload.File))
+		}
+
+		if body.ContentType == "" {
+			body.ContentType = "application/octet-stream"
+		}
+	}
+
+	return body, nil
+}
+
+// RequestBody is the body sent along with a call
+type RequestBody struct {
+	ContentType string
+	Payload     *Payload
+}
+
+// RequestExpect describes the request bodies a function accepts. Requests
+// which do not match are rejected. If Echo is set, the received body is
+// reported back to the caller.
+type RequestExpect struct {
+	ContentType string `json:"ContentType,omitempty" yaml:"ContentType"`
+	MinSize     int    `json:"MinSize,omitempty" yaml:"MinSize"`
+	MaxSize     int    `json:"MaxSize,omitempty" yaml:"MaxSize"`
+	JSON        bool   `json:"JSON,omitempty" yaml:"JSON"`
+	Echo        bool   `json:"Echo,omitempty" yaml:"Echo"`
+}
+
+func (e *RequestExpect) validate() error {
+	if e.MinSize < 0 || e.MaxSize < 0 || (e.MaxSize > 0 && e.MaxSize < e.MinSize) {
+		return fmt.Errorf("invalid request size limits %d..%d", e.MinSize, e.MaxSize)
+	}
+
+	return nil
+}
+
+// ReceivedBody summarizes the request body received by a function
+type ReceivedBody struct {
+	ContentType string          `json:"ContentType,omitempty"`
+	Size        int             `json:"Size"`
+	Body        json.RawMessage `json:"Body,omitempty"`
+}
+
+// ReadRequestBody reads the body of the request and checks it against the
+// expectations of the function. A non-zero status code is returned along
+// with the error if the request must be rejected.
+func ReadRequestBody(req *http.Request, expect *RequestExpect) (*ReceivedBody, int, error) {
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	if len(data) == 0 && expect == nil {
+		return nil, 0, nil
+	}
+
+	received := &ReceivedBody{
+		ContentType: req.Header.Get("Content-Type"),
+		Size:        len(data),
+	}
+
+	if expect == nil {
+		return received, 0, nil
+	}
+
+	if expect.ContentType != "" {
+		mediaType, _, _ := mime.ParseMediaType(received.ContentType)
+		if !strings.EqualFold(mediaType, expect.ContentType) {
+			return received, http.StatusUnsupportedMediaType,
+				fmt.Errorf("expected content type %s, got \"%s\"", expect.ContentType, received.ContentType)
+		}
+	}
+
+	if received.Size < expect.MinSize {
+		return received, http.StatusBadRequest,
+			fmt.Errorf("request body of %d bytes is smaller than %d bytes", received.Size, expect.MinSize)
+	}
+
+	if expect.MaxSize > 0 && received.Size > expect.MaxSize {
+		return received, http.StatusRequestEntityTooLarge,
+			fmt.Errorf("request body of %d bytes exceeds %d bytes", received.Size, expect.MaxSize)
+	}
+
+	if expect.JSON && !json.Valid(data) {
+		return received, http.StatusBadRequest, fmt.Errorf("request body is not valid JSON")
+	}
+
+	if expect.Echo {
+		if json.Valid(data) {
+			received.Body = data
+		} else {
+			received.Body, _ = json.Marshal(string(data))
+		}
+	}
+
+	return received, 0, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	VerdictOK   = "OK"
+	VerdictVuln = "VULN"
+	VerdictNOP  = "NOP"
+)
+
+// CallResult is the result of a single function call. Results of the calls
+// made while handling the call are attached as children so that the
+// complete call graph is reported as a single tree.
+type CallResult struct {
+	Function string          `json:"Function"`
+	Status   int             `json:"Status,omitempty"`
+	Latency  Duration        `json:"Latency,omitempty"`
+	Verdict  string          `json:"Verdict,omitempty"`
+	Data     json.RawMessage `json:"Data,omitempty"`
+	Received *ReceivedBody   `json:"Received,omitempty"`
+	TLS      *TLSInfo        `json:"TLS,omitempty"`
+	Error    string          `json:"Error,omitempty"`
+	Children []*CallResult   `json:"Children,omitempty"`
+}
+
+func NewCallResult(function string) *CallResult {
+	return &CallResult{Function: function}
+}
+
+func NewErrorResult(function string, err error) *CallResult {
+	return &CallResult{Function: function, Error: err.Error()}
+}
+
+// JSON returns the indented JSON representation of the result tree.
+func (r *CallResult) JSON() string {
+	out, err := json.MarshalIndent(r, "", "\t")
+	if err != nil {
+		// Only reachable if the tree contains unsupported values
+		out, _ = json.Marshal(NewErrorResult(r.Function, fmt.Errorf("unable to encode result: %s", err)))
+	}
+
+	return string(out)
+}
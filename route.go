@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// RouteParams are the values captured by the "{name}" and "*" segments of a
+// route pattern. The remainder matched by "*" is stored under the key "*".
+type RouteParams map[string]string
+
+type routeParamsKey struct{}
+
+var routeParamNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func isParamSegment(seg string) bool {
+	return strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}")
+}
+
+// IsRoutePattern returns true if the path contains "{name}" or "*" segments
+func IsRoutePattern(path string) bool {
+	for _, seg := range strings.Split(path, "/") {
+		if seg == "*" || isParamSegment(seg) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateRoute checks the syntax of the "{name}" and "*" segments of a
+// route pattern.
+func ValidateRoute(path string) error {
+	seen := make(map[string]bool)
+	for _, seg := range strings.Split(path, "/") {
+		if isParamSegment(seg) {
+			name := seg[1 : len(seg)-1]
+			if !routeParamNameRe.MatchString(name) {
+				return fmt.Errorf("invalid route parameter \"%s\" in \"%s\"", seg, path)
+			} else if seen[name] {
+				return fmt.Errorf("duplicate route parameter \"%s\" in \"%s\"", seg, path)
+			}
+			seen[name] = true
+		} else if seg != "*" && strings.ContainsAny(seg, "{}*") {
+			return fmt.Errorf("route parameters must span a whole path segment in \"%s\"", path)
+		}
+	}
+	return nil
+}
+
+// matchRoute matches path against the route pattern. A "{name}" segment
+// matches a single non-empty segment, a "*" segment matches a single
+// segment or, as last segment, the remainder of the path.
+func matchRoute(pattern string, path string) (RouteParams, bool) {
+	patSegs := strings.Split(pattern, "/")
+	pathSegs := strings.Split(path, "/")
+	params := make(RouteParams)
+
+	for i, seg := range patSegs {
+		if seg == "*" && i == len(patSegs)-1 {
+			if i >= len(pathSegs) {
+				return nil, false
+			}
+			params["*"] = strings.Join(pathSegs[i:], "/")
+			return params, true
+		}
+
+		if i >= len(pathSegs) {
+			return nil, false
+		}
+
+		switch {
+		case seg == "*":
+			if pathSegs[i] == "" {
+				return nil, false
+			}
+		case isParamSegment(seg):
+			if pathSegs[i] == "" {
+				return nil, false
+			}
+			params[seg[1:len(seg)-1]] = pathSegs[i]
+		case seg != pathSegs[i]:
+			return nil, false
+		}
+	}
+
+	if len(patSegs) != len(pathSegs) {
+		return nil, false
+	}
+
+	return params, true
+}
+
+// routeSpecificity ranks route patterns matching the same path. Patterns
+// with more literal segments win, followed by patterns with more "{name}"
+// segments over "*" segments.
+func routeSpecificity(pattern string) (int, int) {
+	literals, params := 0, 0
+	for _, seg := range strings.Split(pattern, "/") {
+		switch {
+		case seg == "*":
+		case isParamSegment(seg):
+			params++
+		default:
+			literals++
+		}
+	}
+	return literals, params
+}
+
+// RouteRegex returns the regular expression matching the same paths as the
+// route pattern.
+func RouteRegex(pattern string) string {
+	segs := strings.Split(pattern, "/")
+	for i, seg := range segs {
+		switch {
+		case seg == "*" && i == len(segs)-1:
+			segs[i] = ".*"
+		case seg == "*" || isParamSegment(seg):
+			segs[i] = "[^/]+"
+		default:
+			segs[i] = regexp.QuoteMeta(seg)
+		}
+	}
+	return strings.Join(segs, "/")
+}
+
+// ExpandRoute fills the "{name}" and "*" segments of a route pattern with
+// the given parameters. Parameters without a value are replaced with their
+// name so that the resulting path still matches the pattern.
+func ExpandRoute(pattern string, params RouteParams) string {
+	segs := strings.Split(pattern, "/")
+	for i, seg := range segs {
+		switch {
+		case seg == "*":
+			if v := params["*"]; v != "" && i == len(segs)-1 {
+				segs[i] = v
+			} else {
+				segs[i] = "any"
+			}
+		case isParamSegment(seg):
+			name := seg[1 : len(seg)-1]
+			if v, ok := params[name]; ok {
+				segs[i] = v
+			} else {
+				segs[i] = name
+			}
+		}
+	}
+	return strings.Join(segs, "/")
+}
+
+// WithRouteParams returns a shallow copy of req carrying the parameters
+func WithRouteParams(req *http.Request, params RouteParams) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), routeParamsKey{}, params))
+}
+
+// GetRouteParams returns the parameters captured for the request, if any
+func GetRouteParams(req *http.Request) RouteParams {
+	if req == nil {
+		return nil
+	}
+
+	params, _ := req.Context().Value(routeParamsKey{}).(RouteParams)
+	return params
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TCP and UDP functions model L4-only services such as databases or DNS.
+// node-server listens on the port of every socket function of its host and
+// answers with either an echo of the data received or the configured
+// handshake. Socket functions cannot make calls.
+
+const (
+	FuncTypeTCP = "TCP"
+	FuncTypeUDP = "UDP"
+)
+
+// Handshake describes the conversation of a socket function. The server
+// sends Banner when a TCP connection is accepted. If the client sends
+// Expect, the server answers with Reply. Without a handshake, the server
+// echoes the data received.
+type Handshake struct {
+	Banner string `json:"Banner,omitempty" yaml:"Banner"`
+	Expect string `json:"Expect,omitempty" yaml:"Expect"`
+	Reply  string `json:"Reply,omitempty" yaml:"Reply"`
+}
+
+func (h *Handshake) validate(proto string) error {
+	if h.Banner == "" && h.Expect == "" {
+		return fmt.Errorf("handshake requires a Banner or Expect")
+	} else if (h.Expect == "") != (h.Reply == "") {
+		return fmt.Errorf("handshake requires both Expect and Reply")
+	} else if proto == FuncTypeUDP && h.Banner != "" {
+		return fmt.Errorf("UDP handshake cannot send a Banner")
+	}
+
+	return nil
+}
+
+// validateSocketFunc checks that only socket functions have a handshake and
+// that socket functions make no calls.
+func validateSocketFunc(def FuncDef, attrs *FuncAttrs, calls FuncCalls) error {
+	hf, ok := def.(FuncHttp)
+	if !ok || !hf.IsSocket() {
+		if attrs.Handshake != nil {
+			return fmt.Errorf("only TCP and UDP functions have a handshake")
+		}
+		return nil
+	}
+
+	if len(calls) > 0 {
+		return fmt.Errorf("%s functions cannot make calls", hf.method)
+	}
+
+	if attrs.Handshake != nil {
+		return attrs.Handshake.validate(hf.method)
+	}
+
+	return nil
+}
+
+// NewFuncSocket returns the TCP or UDP function listening on host:port
+func NewFuncSocket(proto string, hostPort string) (FuncHttp, error) {
+	if _, port, err := net.SplitHostPort(hostPort); err != nil || port == "" {
+		return FuncHttp{}, fmt.Errorf("%s function requires \"host:port\", got \"%s\"", proto, hostPort)
+	}
+
+	return NewFuncHttp(proto, hostPort)
+}
+
+// IsSocket returns true if the function is a TCP or UDP function
+func (f FuncHttp) IsSocket() bool {
+	return f.method == FuncTypeTCP || f.method == FuncTypeUDP
+}
+
+// Protocol returns the L4 protocol the function is reached over
+func (f FuncHttp) Protocol() string {
+	if f.method == FuncTypeUDP {
+		return FuncTypeUDP
+	}
+	return FuncTypeTCP
+}
+
+// socketProbe returns the data to send to f and the reply expected back
+func socketProbe(f FuncHttp) (*Handshake, []byte, []byte) {
+	hs := definitionTree.Attrs[f].SocketHandshake()
+	if hs == nil {
+		probe := []byte("apisim " + f.String() + "\n")
+		return nil, probe, probe
+	}
+
+	return hs, []byte(hs.Expect), []byte(hs.Reply)
+}
+
+func readExpected(conn net.Conn, expected []byte, what string) error {
+	if len(expected) == 0 {
+		return nil
+	}
+
+	buf := make([]byte, len(expected))
+	if _, ok := conn.(net.PacketConn); ok {
+		// Datagrams are read whole, a longer reply must not match
+		buf = make([]byte, 65535)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return fmt.Errorf("unable to read %s: %s", what, err)
+		}
+		buf = buf[:n]
+	} else if _, err := io.ReadFull(conn, buf); err != nil {
+		return fmt.Errorf("unable to read %s: %s", what, err)
+	}
+
+	if !bytes.Equal(buf, expected) {
+		return fmt.Errorf("unexpected %s %q", what, buf)
+	}
+
+	return nil
+}
+
+// socketRequest probes the socket function f by running its handshake
+func socketRequest(ownFunc FuncDef, f FuncHttp, inReq *http.Request, readBody bool,
+	timeout time.Duration) *CallResult {
+	result := NewCallResult(f.String())
+	hs, send, expected := socketProbe(f)
+
+	start := time.Now()
+	network := strings.ToLower(f.Protocol())
+	conn, err := net.DialTimeout(network, dialAddr(network, string(f.host)+":"+string(f.port)), timeout)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer conn.Close()
+	conn.SetDeadline(start.Add(timeout))
+
+	if hs != nil {
+		err = readExpected(conn, []byte(hs.Banner), "banner")
+	}
+
+	if err == nil && len(send) > 0 {
+		if _, err = conn.Write(send); err == nil {
+			err = readExpected(conn, expected, "reply")
+		}
+	}
+
+	result.Latency = Duration(time.Since(start))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	setVerdict(result, ownFunc, f, inReq, readBody)
+	return result
+}
+
+// socketFault returns the fault to inject into the current exchange. All
+// faults other than hangs and truncated replies drop the connection.
+func socketFault(def FuncDef) *Fault {
+	SimulateLatency(def)
+
+	fault := definitionTree.Faults[def].Pick()
+	if fault != nil {
+		log.Infof("Injecting fault \"%s\" into %+v", fault, def)
+	}
+	return fault
+}
+
+func writeReply(w io.Writer, reply []byte, fault *Fault) {
+	if fault != nil && fault.Type == FaultTruncate {
+		reply = reply[:len(reply)/2]
+	}
+	w.Write(reply)
+}
+
+func serveTCPConn(def FuncHttp, conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(Timeout))
+
+	fault := socketFault(def)
+	if fault != nil && fault.Type == FaultHang {
+		io.Copy(ioutil.Discard, conn)
+		return
+	} else if fault != nil && fault.Type != FaultTruncate {
+		return
+	}
+
+	hs := definitionTree.Attrs[def].SocketHandshake()
+	if hs == nil {
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 {
+				writeReply(conn, buf[:n], fault)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	if hs.Banner != "" {
+		writeReply(conn, []byte(hs.Banner), fault)
+	}
+
+	if hs.Expect != "" {
+		if err := readExpected(conn, []byte(hs.Expect), "request"); err != nil {
+			log.Infof("%+v rejected connection from %s: %s", def, conn.RemoteAddr(), err)
+			return
+		}
+		writeReply(conn, []byte(hs.Reply), fault)
+	}
+}
+
+func serveUDP(def FuncHttp, conn net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Errorf("%+v stopped serving: %s", def, err)
+			return
+		}
+
+		fault := socketFault(def)
+		if fault != nil && fault.Type != FaultTruncate {
+			continue
+		}
+
+		reply := buf[:n]
+		if hs := definitionTree.Attrs[def].SocketHandshake(); hs != nil {
+			if string(reply) != hs.Expect {
+				log.Infof("%+v ignoring unexpected datagram from %s", def, addr)
+				continue
+			}
+			reply = []byte(hs.Reply)
+		}
+
+		var out bytes.Buffer
+		writeReply(&out, reply, fault)
+		conn.WriteTo(out.Bytes(), addr)
+	}
+}
+
+// ServeSockets listens for the socket functions of host, or of all hosts
+// if host is empty. Functions of different hosts sharing a port are served
+// by the first function in alphabetical order.
+func ServeSockets(host string) {
+	var funcs []FuncHttp
+	for key := range definitionTree.Funcs {
+		if hf, ok := key.(FuncHttp); ok && hf.IsSocket() && (host == "" || string(hf.host) == host) {
+			funcs = append(funcs, hf)
+		}
+	}
+	sort.Slice(funcs, func(i, j int) bool { return funcs[i].String() < funcs[j].String() })
+
+	listening := make(map[string]bool)
+	for _, hf := range funcs {
+		addr := ":" + string(hf.port)
+		if listening[hf.Protocol()+addr] {
+			log.Warningf("%+v shares %s port %s with another function, not serving it", hf, hf.Protocol(), hf.port)
+			continue
+		}
+		listening[hf.Protocol()+addr] = true
+
+		if _, err := ServeSocket(hf, addr); err != nil {
+			log.Errorf("Unable to listen for %+v: %s", hf, err)
+		}
+	}
+}
+
+// ServeSocket listens on addr for the socket function hf and returns the
+// address it is bound to.
+func ServeSocket(hf FuncHttp, addr string) (string, error) {
+	if hf.method == FuncTypeUDP {
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return "", err
+		}
+		log.Infof("Listening on UDP %s for %+v", conn.LocalAddr(), hf)
+		go serveUDP(hf, conn)
+		return conn.LocalAddr().String(), nil
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	log.Infof("Listening on TCP %s for %+v", l.Addr(), hf)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				log.Errorf("%+v stopped serving: %s", hf, err)
+				return
+			}
+			go serveTCPConn(hf, conn)
+		}
+	}()
+
+	return l.Addr().String(), nil
+}
@@ -5,11 +5,17 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 
 	"github.com/mailgun/manners"
 	"github.com/urfave/cli"
 )
 
+const (
+	StatusModeNeighbor = "neighbor"
+	StatusModeExploit  = "exploit"
+)
+
 var (
 	statusPort int
 
@@ -37,7 +43,10 @@ func statusHandler(w http.ResponseWriter, req *http.Request) {
 		for port, funcNode := range funcPort {
 			for node := range funcNode {
 				uri := fmt.Sprintf("%s:%s%s", host, port, node.path)
-				httpFunc, err := NewFuncHttp(node.method, uri)
+				if node.query != "" {
+					uri += "?" + node.query
+				}
+				httpFunc, err := NewFuncHttp(node.method, uri, strings.Fields(node.headers)...)
 				if err != nil {
 					continue
 				}
@@ -47,18 +56,47 @@ func statusHandler(w http.ResponseWriter, req *http.Request) {
 		}
 	}
 
-	result := "[" + FuncMux(funcs, req, FuncHttp{}, NeighborRequest) + "]"
-	fmt.Fprintf(w, "jsonCallback(%s);\n", PrettyJSON(result))
+	result := NewCallResult("status")
+	status := http.StatusOK
+	switch mode := req.URL.Query().Get("mode"); mode {
+	case "", StatusModeNeighbor:
+		result.Children = FuncMux(funcs, WithIdentity(req, statusIdentity), FuncHttp{}, NeighborRequest)
+	case StatusModeExploit:
+		// Each function attempts to call all others, the functions called
+		// only answer the attempt without handling it.
+		req.Header.Set("Exploit", "True")
+		req.Header.Set("ExploitDepth", "2")
+		result.Children = FuncMux(funcs, WithIdentity(req, statusIdentity), FuncHttp{}, HttpRequest)
+	default:
+		result.Error = fmt.Sprintf("unknown mode \"%s\"", mode)
+		status = http.StatusBadRequest
+	}
+
+	asJSON := req.URL.Query().Get("format") == "json"
+	if asJSON {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(status)
+
+	if asJSON {
+		fmt.Fprintln(w, result.JSON())
+	} else {
+		fmt.Fprintf(w, "jsonCallback(%s);\n", result.JSON())
+	}
 }
 
-func runStatus(cli *cli.Context) {
+func newStatusServer() *manners.GracefulServer {
 	addr := fmt.Sprintf(":%d", statusPort)
-	log.Info("Listening on %s", addr)
+	log.Infof("Listening on %s", addr)
 
-	s := manners.NewWithServer(&http.Server{
+	return manners.NewWithServer(&http.Server{
 		Addr:    addr,
 		Handler: http.HandlerFunc(statusHandler),
 	})
+}
+
+func runStatus(cli *cli.Context) {
+	s := newStatusServer()
 
 	go func() {
 		sigchan := make(chan os.Signal, 1)
@@ -68,7 +106,7 @@ func runStatus(cli *cli.Context) {
 		s.Close()
 	}()
 
-	if err := s.ListenAndServe(); err != nil {
+	if err := listenAndServe(s, []string{statusIdentity}, false); err != nil {
 		log.Fatal(err)
 	}
 }
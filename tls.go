@@ -0,0 +1,450 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mailgun/manners"
+	"github.com/urfave/cli"
+)
+
+// With --tls, function nodes serve and call functions over TLS using the
+// certificates written by generate-certs: a local CA and one certificate
+// per host, which doubles as server and client certificate. With --mtls,
+// callers present the certificate of their host and nodes reject callers
+// without a valid one. The identities of both ends are reported in the
+// call results. TCP and UDP functions are not affected.
+
+const (
+	caName         = "ca"
+	statusIdentity = "status"
+	certValidity   = 365 * 24 * time.Hour
+)
+
+var (
+	TLSEnabled  bool
+	MutualTLS   bool
+	TLSDir      string
+	certHosts   string
+	certsForced bool
+
+	GenerateCertsCommand = cli.Command{
+		Name:     "generate-certs",
+		Usage:    "Generate a CA and a certificate for each host",
+		Category: "Certificate generation",
+		Action:   generateCerts,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Destination: &certHosts,
+				Name:        "hosts",
+				Usage:       "Additional comma separated names to add to each certificate",
+			},
+			cli.BoolFlag{
+				Destination: &certsForced,
+				Name:        "f, force",
+				Usage:       "Replace existing certificates",
+			},
+		},
+	}
+)
+
+// TLSInfo describes the TLS session of a call. Server is the identity of
+// the certificate presented by the called function, Client the identity
+// of the certificate presented by the caller as seen by the called
+// function.
+type TLSInfo struct {
+	Version string `json:"Version,omitempty"`
+	Proto   string `json:"Proto,omitempty"`
+	Server  string `json:"Server,omitempty"`
+	Client  string `json:"Client,omitempty"`
+}
+
+type identityKey struct{}
+
+// WithIdentity returns a shallow copy of req carrying the identity used
+// for the calls made while handling it.
+func WithIdentity(req *http.Request, name string) *http.Request {
+	if host, _, err := net.SplitHostPort(name); err == nil {
+		name = host
+	}
+	return req.WithContext(context.WithValue(req.Context(), identityKey{}, name))
+}
+
+// GetIdentity returns the identity of the function handling req
+func GetIdentity(req *http.Request) string {
+	if req == nil {
+		return ""
+	}
+
+	name, _ := req.Context().Value(identityKey{}).(string)
+	return name
+}
+
+// certIdentity returns the name a certificate was issued for
+func certIdentity(cert *x509.Certificate) string {
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	} else if len(cert.IPAddresses) > 0 {
+		return cert.IPAddresses[0].String()
+	}
+	return cert.Subject.CommonName
+}
+
+// sessionInfo returns the version and protocol of the TLS session
+func sessionInfo(state *tls.ConnectionState) *TLSInfo {
+	return &TLSInfo{
+		Version: tls.VersionName(state.Version),
+		Proto:   state.NegotiatedProtocol,
+	}
+}
+
+// peerIdentity returns the identity of the verified peer certificate of the
+// TLS session, if any
+func peerIdentity(state *tls.ConnectionState) string {
+	if len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return certIdentity(state.PeerCertificates[0])
+}
+
+var (
+	certMutex sync.Mutex
+	certCache = make(map[string]*tls.Certificate)
+	caPool    *x509.CertPool
+
+	transportMutex sync.Mutex
+	transports     = make(map[string]*http.Transport)
+)
+
+func certPath(name string) (string, string) {
+	return filepath.Join(TLSDir, name+".crt"), filepath.Join(TLSDir, name+".key")
+}
+
+// loadCertificate returns the certificate of name from the certificate
+// directory.
+func loadCertificate(name string) (*tls.Certificate, error) {
+	certMutex.Lock()
+	defer certMutex.Unlock()
+
+	if cert, ok := certCache[name]; ok {
+		return cert, nil
+	}
+
+	certFile, keyFile := certPath(name)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load certificate of \"%s\": %s", name, err)
+	}
+
+	certCache[name] = &cert
+	return &cert, nil
+}
+
+func loadCAPool() (*x509.CertPool, error) {
+	certMutex.Lock()
+	defer certMutex.Unlock()
+
+	if caPool != nil {
+		return caPool, nil
+	}
+
+	certFile, _ := certPath(caName)
+	data, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read CA certificate: %s", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate found in \"%s\"", certFile)
+	}
+
+	caPool = pool
+	return pool, nil
+}
+
+// certNames returns the names certificates are issued for, the status
+// server and every host of the definition.
+func certNames() []string {
+	names := append([]string{statusIdentity}, sortedHosts(GetExternalFuncTree())...)
+	sort.Strings(names)
+	return names
+}
+
+// ServerTLSConfig returns the TLS configuration of a server serving the
+// functions of names. Only the certificates of names are loaded, the one
+// presented is chosen by the server name requested by the client, falling
+// back to the certificate of the first name.
+func ServerTLSConfig(names []string, requireClientCert bool) (*tls.Config, error) {
+	pool, err := loadCAPool()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no certificate to serve")
+	}
+
+	certs := make(map[string]*tls.Certificate)
+	for _, name := range names {
+		cert, err := loadCertificate(name)
+		if err != nil {
+			return nil, err
+		}
+		certs[name] = cert
+	}
+
+	clientAuth := tls.VerifyClientCertIfGiven
+	if requireClientCert {
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+		ClientAuth: clientAuth,
+		ClientCAs:  pool,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if cert, ok := certs[hello.ServerName]; ok {
+				return cert, nil
+			}
+			return certs[names[0]], nil
+		},
+	}, nil
+}
+
+// clientTransport returns the transport used for calls made by identity.
+// Transports are shared so that connections are reused across calls.
+func clientTransport(identity string, grpc bool) (*http.Transport, error) {
+	key := fmt.Sprintf("%s/%t", identity, grpc)
+
+	transportMutex.Lock()
+	defer transportMutex.Unlock()
+
+	if t, ok := transports[key]; ok {
+		return t, nil
+	}
+
+	pool, err := loadCAPool()
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    pool,
+	}
+
+	if MutualTLS {
+		if identity == "" {
+			return nil, fmt.Errorf("unable to present a client certificate, identity unknown")
+		}
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return loadCertificate(identity)
+		}
+	}
+
+	protocols := new(http.Protocols)
+	protocols.SetHTTP2(true)
+	if !grpc {
+		protocols.SetHTTP1(true)
+	}
+
+	t := &http.Transport{
+		DialContext:     dialContext,
+		TLSClientConfig: config,
+		Protocols:       protocols,
+	}
+	transports[key] = t
+	return t, nil
+}
+
+// listenAndServe starts the server, over TLS if enabled. names are the
+// hosts whose certificates the server presents, see ServerTLSConfig.
+func listenAndServe(s *manners.GracefulServer, names []string, requireClientCert bool) error {
+	ln, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+
+	return serveListener(s, ln, names, requireClientCert)
+}
+
+// serveListener serves connections accepted by ln, over TLS if enabled
+func serveListener(s *manners.GracefulServer, ln net.Listener, names []string, requireClientCert bool) error {
+	if TLSEnabled {
+		config, err := ServerTLSConfig(names, requireClientCert)
+		if err != nil {
+			ln.Close()
+			return err
+		}
+		ln = tls.NewListener(ln, config)
+	}
+
+	return s.Serve(ln)
+}
+
+func writePEM(path string, typ string, data []byte, mode os.FileMode) error {
+	return ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: data}), mode)
+}
+
+func writeKeyPair(name string, cert []byte, key *ecdsa.PrivateKey) error {
+	certFile, keyFile := certPath(name)
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := writePEM(keyFile, "EC PRIVATE KEY", der, 0600); err != nil {
+		return err
+	}
+
+	return writePEM(certFile, "CERTIFICATE", cert, 0644)
+}
+
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// loadOrCreateCA returns the CA of the certificate directory, creating it
+// if it does not exist yet.
+func loadOrCreateCA() (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certFile, keyFile := certPath(caName)
+
+	if pair, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil && !certsForced {
+		cert, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, nil, fmt.Errorf("unsupported CA key type")
+		}
+		return cert, key, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := newSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "apisim CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(certValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := writeKeyPair(caName, der, key); err != nil {
+		return nil, nil, err
+	}
+
+	log.Infof("Generated CA %s", certFile)
+	cert, err := x509.ParseCertificate(der)
+	return cert, key, err
+}
+
+func createHostCert(name string, extra []string, ca *x509.Certificate, caKey *ecdsa.PrivateKey) error {
+	certFile, _ := certPath(name)
+	if _, err := os.Stat(certFile); err == nil && !certsForced {
+		log.Infof("Keeping existing certificate %s", certFile)
+		return nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := newSerial()
+	if err != nil {
+		return err
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(certValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	for _, n := range append([]string{name}, extra...) {
+		if ip := net.ParseIP(n); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, n)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Generating certificate %s...", certFile)
+	return writeKeyPair(name, der, key)
+}
+
+func generateCerts(ctx *cli.Context) {
+	if err := os.MkdirAll(TLSDir, 0755); err != nil {
+		log.Fatalf("Unable to create certificate directory: %s", err)
+	}
+
+	ca, caKey, err := loadOrCreateCA()
+	if err != nil {
+		log.Fatalf("Unable to create CA: %s", err)
+	}
+
+	names := certNames()
+
+	var extra []string
+	for _, n := range strings.Split(certHosts, ",") {
+		if n = strings.TrimSpace(n); n != "" {
+			extra = append(extra, n)
+		}
+	}
+
+	for _, name := range names {
+		hosts := extra
+		if name == statusIdentity {
+			// verify reaches the status server on localhost by default
+			hosts = append([]string{"localhost", "127.0.0.1"}, extra...)
+		}
+		if err := createHostCert(name, hosts, ca, caKey); err != nil {
+			log.Fatalf("Unable to create certificate of \"%s\": %s", name, err)
+		}
+	}
+}
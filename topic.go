@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// PUBLISH and SUBSCRIBE functions model asynchronous message edges through
+// a topic. "PUBLISH topic broker" is served by the node running on the
+// broker host and stands in for a Kafka broker: every message published to
+// the topic is delivered to all "SUBSCRIBE topic host" functions before the
+// publish call returns, so the fan-out shows up in the call tree. Messages
+// travel as HTTP requests with the method PUBLISH or SUBSCRIBE to the path
+// /topics/<topic>.
+
+const (
+	FuncTypePublish   = "PUBLISH"
+	FuncTypeSubscribe = "SUBSCRIBE"
+	topicPathPrefix   = "/topics/"
+)
+
+var topicNameRe = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// NewFuncTopic returns the PUBLISH or SUBSCRIBE function for topic served
+// by host. The function is represented as the HTTP request it maps to.
+func NewFuncTopic(kind string, topic string, host string) (FuncHttp, error) {
+	if !topicNameRe.MatchString(topic) {
+		return FuncHttp{}, fmt.Errorf("invalid topic name \"%s\"", topic)
+	}
+
+	return NewFuncHttp(kind, host+topicPathPrefix+topic)
+}
+
+// IsTopic returns true if the function publishes or subscribes to a topic
+func (f FuncHttp) IsTopic() bool {
+	return f.method == FuncTypePublish || f.method == FuncTypeSubscribe
+}
+
+// Topic returns the name of the topic of a PUBLISH or SUBSCRIBE function
+func (f FuncHttp) Topic() string {
+	return strings.TrimPrefix(f.path, topicPathPrefix)
+}
+
+func IsTopicRequest(req *http.Request) bool {
+	return (req.Method == FuncTypePublish || req.Method == FuncTypeSubscribe) &&
+		strings.HasPrefix(req.URL.Path, topicPathPrefix)
+}
+
+// TopicMessage is a message published to a topic
+type TopicMessage struct {
+	ContentType string
+	Data        []byte
+}
+
+type topicMessageKey struct{}
+
+// WithTopicMessage reads the message published with req and returns a
+// shallow copy of req carrying the message for delivery to subscribers.
+// The body of the returned request can still be read.
+func WithTopicMessage(req *http.Request) (*http.Request, error) {
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(data))
+
+	if len(data) == 0 {
+		return req, nil
+	}
+
+	msg := &TopicMessage{
+		ContentType: req.Header.Get("Content-Type"),
+		Data:        data,
+	}
+	if msg.ContentType == "" {
+		msg.ContentType = "application/octet-stream"
+	}
+
+	return req.WithContext(context.WithValue(req.Context(), topicMessageKey{}, msg)), nil
+}
+
+// GetTopicMessage returns the message published with the request, if any
+func GetTopicMessage(req *http.Request) *TopicMessage {
+	if req == nil {
+		return nil
+	}
+
+	msg, _ := req.Context().Value(topicMessageKey{}).(*TopicMessage)
+	return msg
+}
+
+// linkTopics makes every PUBLISH function call all SUBSCRIBE functions of
+// its topic.
+func (f *FuncTree) linkTopics() error {
+	subscribers := make(map[string]FuncCalls)
+	for key := range f.Funcs {
+		if hf, ok := key.(FuncHttp); ok && hf.method == FuncTypeSubscribe {
+			subscribers[hf.Topic()] = append(subscribers[hf.Topic()], hf)
+		}
+	}
+
+	for _, calls := range subscribers {
+		sort.Slice(calls, func(i, j int) bool { return calls[i].String() < calls[j].String() })
+	}
+
+	for key, calls := range f.Funcs {
+		for _, call := range calls {
+			if hf, ok := call.(FuncHttp); ok && hf.method == FuncTypeSubscribe {
+				return fmt.Errorf("\"%s\" cannot be called by \"%s\", publish to the topic instead", hf, key)
+			}
+		}
+
+		hf, ok := key.(FuncHttp)
+		if !ok || hf.method != FuncTypePublish {
+			continue
+		}
+
+		if len(calls) > 0 {
+			return fmt.Errorf("\"%s\" delivers to the subscribers of the topic and cannot make calls", hf)
+		}
+
+		f.Funcs[key] = subscribers[hf.Topic()]
+	}
+
+	return nil
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+var (
+	verifyStatusAddr string
+	verifyModes      string
+	verifyFormat     string
+	verifyOutput     string
+
+	VerifyCommand = cli.Command{
+		Name:     "verify",
+		Usage:    "Verifies reachability of all functions against the definition via the status server",
+		Category: "Function simulation",
+		Action:   runVerify,
+		Flags: []cli.Flag{
+			cli.StringFlag{
+				Destination: &verifyStatusAddr,
+				Name:        "s, status",
+				Value:       "localhost:8888",
+				Usage:       "Address of the status server",
+			},
+			cli.StringFlag{
+				Destination: &verifyModes,
+				Name:        "m, mode",
+				Value:       StatusModeNeighbor + "," + StatusModeExploit,
+				Usage:       "Comma separated list of modes to verify in",
+			},
+			cli.StringFlag{
+				Destination: &verifyFormat,
+				Name:        "f, format",
+				Value:       VerifyFormatText,
+				Usage:       "Output format: text, junit, sarif or json",
+			},
+			cli.StringFlag{
+				Destination: &verifyOutput,
+				Name:        "o, output",
+				Usage:       "Path of the file to write the results to instead of stdout",
+			},
+		},
+	}
+)
+
+const (
+	OutcomeAllowed = "allowed"
+	OutcomeDenied  = "denied"
+	OutcomeVuln    = "unexpected"
+	OutcomeBlocked = "blocked"
+)
+
+// VerifyCall is the expected and observed reachability of callee from
+// caller. Calls made by the status server are always expected to succeed.
+type VerifyCall struct {
+	Caller   string
+	Callee   string
+	Expected bool
+	Reached  bool
+	Error    string
+}
+
+// Outcome returns how the observed reachability compares to the expected
+func (c VerifyCall) Outcome() string {
+	switch {
+	case c.Expected && c.Reached:
+		return OutcomeAllowed
+	case c.Expected:
+		return OutcomeBlocked
+	case c.Reached:
+		return OutcomeVuln
+	}
+	return OutcomeDenied
+}
+
+// Failed returns true if the call was reachable but not expected to be, or
+// expected but blocked.
+func (c VerifyCall) Failed() bool {
+	return c.Expected != c.Reached
+}
+
+// VerifyReport is the reachability matrix of all functions in one mode
+type VerifyReport struct {
+	Mode  string
+	Funcs []string
+	Calls []VerifyCall
+}
+
+// NewVerifyReport builds the report from the result tree returned by the
+// status server, the function calls of the status server form the first
+// row of the matrix.
+func NewVerifyReport(mode string, status *CallResult) *VerifyReport {
+	calls := make(map[string]map[string]bool)
+	for key, keyCalls := range definitionTree.Funcs {
+		calls[key.String()] = make(map[string]bool)
+		for _, c := range keyCalls {
+			calls[key.String()][c.String()] = true
+		}
+	}
+
+	report := &VerifyReport{Mode: mode}
+	funcs := make(map[string]bool)
+	for _, f := range status.Children {
+		report.Funcs = append(report.Funcs, f.Function)
+		funcs[f.Function] = true
+	}
+
+	for _, f := range status.Children {
+		report.Calls = append(report.Calls, VerifyCall{
+			Caller:   statusIdentity,
+			Callee:   f.Function,
+			Expected: true,
+			Reached:  f.Error == "",
+			Error:    f.Error,
+		})
+
+		if f.Error != "" {
+			continue
+		}
+
+		for _, c := range f.Children {
+			// Skip the function itself and data returned in exploit mode
+			if c.Verdict == VerdictNOP || !funcs[c.Function] {
+				continue
+			}
+
+			report.Calls = append(report.Calls, VerifyCall{
+				Caller:   f.Function,
+				Callee:   c.Function,
+				Expected: calls[f.Function][c.Function],
+				Reached:  c.Error == "" && c.Verdict != "",
+				Error:    c.Error,
+			})
+		}
+	}
+
+	return report
+}
+
+// Failures returns the calls not matching the definition
+func (r *VerifyReport) Failures() []VerifyCall {
+	var failures []VerifyCall
+	for _, c := range r.Calls {
+		if c.Failed() {
+			failures = append(failures, c)
+		}
+	}
+	return failures
+}
+
+var outcomeSymbols = map[string]string{
+	OutcomeAllowed: "+",
+	OutcomeDenied:  ".",
+	OutcomeVuln:    "V",
+	OutcomeBlocked: "X",
+}
+
+// Print writes the matrix with one row per caller and one column per callee
+// followed by the list of failed calls.
+func (r *VerifyReport) Print(w io.Writer) {
+	index := make(map[string]int)
+	fmt.Fprintf(w, "Mode: %s\n\n", r.Mode)
+	for i, f := range r.Funcs {
+		index[f] = i
+		fmt.Fprintf(w, "%4d  %s\n", i+1, f)
+	}
+
+	cells := make(map[string][]string)
+	rows := append([]string{statusIdentity}, r.Funcs...)
+	for i, row := range rows {
+		cells[row] = make([]string, len(r.Funcs))
+		for j := range r.Funcs {
+			cells[row][j] = "?"
+			if i == j+1 {
+				cells[row][j] = "-"
+			}
+		}
+	}
+	for _, c := range r.Calls {
+		if j, ok := index[c.Callee]; ok {
+			cells[c.Caller][j] = outcomeSymbols[c.Outcome()]
+		}
+	}
+
+	fmt.Fprintf(w, "\n%-8s", "")
+	for i := range r.Funcs {
+		fmt.Fprintf(w, "%4d", i+1)
+	}
+	fmt.Fprintln(w)
+	for i, row := range rows {
+		label := row
+		if i > 0 {
+			label = fmt.Sprint(i)
+		}
+		fmt.Fprintf(w, "%-8s", label)
+		for _, cell := range cells[row] {
+			fmt.Fprintf(w, "%4s", cell)
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintln(w, "\n+ allowed, . denied, V reachable but not called, X called but blocked, ? not observed")
+
+	failures := r.Failures()
+	for _, c := range failures {
+		fmt.Fprintf(w, "%-10s %s -> %s", strings.ToUpper(c.Outcome()), c.Caller, c.Callee)
+		if c.Error != "" {
+			fmt.Fprintf(w, ": %s", c.Error)
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "\n%d calls verified, %d failed\n\n", len(r.Calls), len(failures))
+}
+
+func writeText(w io.Writer, reports []*VerifyReport) error {
+	for _, report := range reports {
+		report.Print(w)
+	}
+	return nil
+}
+
+// fetchStatus requests the result tree of mode from the status server
+func fetchStatus(mode string) (*CallResult, error) {
+	client := &http.Client{Timeout: Timeout * 16}
+
+	scheme := "http"
+	if TLSEnabled {
+		scheme = "https"
+		t, err := clientTransport(statusIdentity, false)
+		if err != nil {
+			return nil, err
+		}
+		client.Transport = t
+	}
+
+	url := fmt.Sprintf("%s://%s/?mode=%s&format=json", scheme, verifyStatusAddr, mode)
+	log.Infof("Requesting %s", url)
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &CallResult{}
+	if err := json.Unmarshal(body, result); err != nil {
+		return nil, fmt.Errorf("invalid response from status server: %s", err)
+	}
+	if result.Error != "" {
+		return nil, fmt.Errorf("status server: %s", result.Error)
+	}
+
+	return result, nil
+}
+
+// verifyReports runs the status server in all requested modes
+func verifyReports() []*VerifyReport {
+	var reports []*VerifyReport
+	for _, mode := range strings.Split(verifyModes, ",") {
+		mode = strings.TrimSpace(mode)
+		if mode != StatusModeNeighbor && mode != StatusModeExploit {
+			log.Fatalf("Unknown mode \"%s\"", mode)
+		}
+
+		result, err := fetchStatus(mode)
+		if err != nil {
+			log.Fatalf("Unable to verify in %s mode: %s", mode, err)
+		}
+		reports = append(reports, NewVerifyReport(mode, result))
+	}
+	return reports
+}
+
+func runVerify(cli *cli.Context) {
+	var write func(io.Writer, []*VerifyReport) error
+	switch verifyFormat {
+	case VerifyFormatText:
+		write = writeText
+	case VerifyFormatJUnit:
+		write = writeJUnit
+	case VerifyFormatSARIF:
+		write = writeSARIF
+	case VerifyFormatJSON:
+		write = writeJSON
+	default:
+		log.Fatalf("Unknown output format \"%s\"", verifyFormat)
+	}
+
+	reports := verifyReports()
+
+	out := os.Stdout
+	if verifyOutput != "" {
+		var err error
+		if out, err = os.Create(verifyOutput); err != nil {
+			log.Fatalf("Unable to open \"%s\" for writing: %s", verifyOutput, err)
+		}
+	}
+
+	if err := write(out, reports); err != nil {
+		log.Fatalf("Unable to write results: %s", err)
+	}
+
+	// Close explicitly, os.Exit below skips deferred calls
+	if out != os.Stdout {
+		if err := out.Close(); err != nil {
+			log.Fatalf("Unable to write results: %s", err)
+		}
+	}
+
+	for _, report := range reports {
+		if len(report.Failures()) > 0 {
+			os.Exit(1)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	VerifyFormatText  = "text"
+	VerifyFormatJUnit = "junit"
+	VerifyFormatSARIF = "sarif"
+	VerifyFormatJSON  = "json"
+)
+
+// writeJSON writes the reports as a JSON list, as read by readVerifyReports
+func writeJSON(w io.Writer, reports []*VerifyReport) error {
+	out, err := json.MarshalIndent(reports, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(w, string(out))
+	return err
+}
+
+// readVerifyReports reads reports written in the JSON format
+func readVerifyReports(path string) ([]*VerifyReport, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var reports []*VerifyReport
+	if err := json.Unmarshal(content, &reports); err != nil {
+		return nil, fmt.Errorf("invalid verification result %s: %s", path, err)
+	}
+	return reports, nil
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Name    string           `xml:"name,attr"`
+	Tests   int              `xml:"tests,attr"`
+	Fail    int              `xml:"failures,attr"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name  string          `xml:"name,attr"`
+	Tests int             `xml:"tests,attr"`
+	Fail  int             `xml:"failures,attr"`
+	Cases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// callMessage describes the outcome of c in a sentence
+func callMessage(c VerifyCall) string {
+	var msg string
+	switch c.Outcome() {
+	case OutcomeAllowed:
+		msg = fmt.Sprintf("%s can reach %s as defined", c.Caller, c.Callee)
+	case OutcomeDenied:
+		msg = fmt.Sprintf("%s cannot reach %s as defined", c.Caller, c.Callee)
+	case OutcomeVuln:
+		msg = fmt.Sprintf("%s can reach %s but does not call it", c.Caller, c.Callee)
+	case OutcomeBlocked:
+		msg = fmt.Sprintf("%s calls %s but is blocked", c.Caller, c.Callee)
+	}
+
+	if c.Error != "" && c.Failed() {
+		msg += ": " + c.Error
+	}
+	return msg
+}
+
+// writeJUnit writes one test suite per mode with one test case per edge
+func writeJUnit(w io.Writer, reports []*VerifyReport) error {
+	suites := junitTestSuites{Name: "apisim verify"}
+	for _, r := range reports {
+		suite := junitTestSuite{Name: r.Mode}
+		for _, c := range r.Calls {
+			tc := junitTestCase{
+				Name:      c.Caller + " -> " + c.Callee,
+				ClassName: "apisim." + r.Mode,
+			}
+			if c.Failed() {
+				msg := callMessage(c)
+				tc.Failure = &junitFailure{Message: msg, Type: c.Outcome(), Text: msg}
+				suite.Fail++
+			}
+			suite.Cases = append(suite.Cases, tc)
+		}
+		suite.Tests = len(suite.Cases)
+
+		suites.Tests += suite.Tests
+		suites.Fail += suite.Fail
+		suites.Suites = append(suites.Suites, suite)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(suites); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool struct {
+		Driver struct {
+			Name           string      `json:"name"`
+			InformationURI string      `json:"informationUri"`
+			Rules          []sarifRule `json:"rules"`
+		} `json:"driver"`
+	} `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID     string            `json:"ruleId"`
+	Level      string            `json:"level"`
+	Message    sarifMessage      `json:"message"`
+	Locations  []sarifLocation   `json:"locations"`
+	Properties map[string]string `json:"properties"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation struct {
+		ArtifactLocation struct {
+			URI string `json:"uri"`
+		} `json:"artifactLocation"`
+	} `json:"physicalLocation"`
+	LogicalLocations []sarifLogicalLocation `json:"logicalLocations"`
+}
+
+type sarifLogicalLocation struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+}
+
+var sarifRules = map[string]sarifRule{
+	OutcomeVuln: {
+		ID:               "apisim/over-permissive",
+		ShortDescription: sarifMessage{"Function can reach a function it does not call"},
+	},
+	OutcomeBlocked: {
+		ID:               "apisim/blocked-call",
+		ShortDescription: sarifMessage{"Function call defined in the definition is blocked"},
+	},
+}
+
+// writeSARIF writes the failed edges of all modes as SARIF results located
+// in the definition file. Over-permissive edges are errors, blocked calls
+// are warnings.
+func writeSARIF(w io.Writer, reports []*VerifyReport) error {
+	run := sarifRun{Results: []sarifResult{}}
+	run.Tool.Driver.Name = "apisim"
+	run.Tool.Driver.InformationURI = "https://github.com/tgraf/apisim"
+	run.Tool.Driver.Rules = []sarifRule{sarifRules[OutcomeVuln], sarifRules[OutcomeBlocked]}
+
+	for _, r := range reports {
+		for _, c := range r.Failures() {
+			result := sarifResult{
+				RuleID:  sarifRules[c.Outcome()].ID,
+				Level:   "error",
+				Message: sarifMessage{fmt.Sprintf("%s (%s mode)", callMessage(c), r.Mode)},
+				Properties: map[string]string{
+					"mode":   r.Mode,
+					"caller": c.Caller,
+					"callee": c.Callee,
+				},
+			}
+			if c.Outcome() == OutcomeBlocked {
+				result.Level = "warning"
+			}
+
+			loc := sarifLocation{}
+			loc.PhysicalLocation.ArtifactLocation.URI = configFile
+			loc.LogicalLocations = []sarifLogicalLocation{{c.Caller, "function"}}
+			result.Locations = []sarifLocation{loc}
+
+			run.Results = append(run.Results, result)
+		}
+	}
+
+	out, err := json.MarshalIndent(sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs:    []sarifRun{run},
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(w, string(out))
+	return err
+}
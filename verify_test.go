@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+// serveTestCluster serves all functions of the definition on local ports
+// like the cluster command and returns a function stopping the servers.
+func serveTestCluster(t *testing.T, def string) func() {
+	funcPort := ConfigFuncPort
+	ConfigFuncPort = 8080
+
+	definitionTree = NewFuncTree()
+	if err := json.Unmarshal([]byte(def), definitionTree); err != nil {
+		t.Fatal(err)
+	}
+
+	var stops []func()
+	for _, host := range sortedHosts(GetExternalFuncTree()) {
+		for _, port := range httpPorts(host) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			key := dialKey("tcp", host+":"+string(port))
+			dialOverrides[key] = ln.Addr().String()
+
+			s := newFuncServer("", host, port)
+			go s.Serve(ln)
+			stops = append(stops, func() {
+				s.Close()
+				delete(dialOverrides, key)
+			})
+		}
+	}
+
+	return func() {
+		for _, stop := range stops {
+			stop()
+		}
+		ConfigFuncPort = funcPort
+
+		// Pooled connections lead to the stopped servers
+		httpTransport.CloseIdleConnections()
+		grpcTransport.CloseIdleConnections()
+	}
+}
+
+func TestVerifyExploitGrpc(t *testing.T) {
+	defer func(tree *FuncTree) { definitionTree = tree }(definitionTree)
+	defer serveTestCluster(t, `{
+		"Functions": {
+			"GET function-a/": [ "GRPC users.Get function-b" ],
+			"GRPC users.Get function-b": [],
+			"GET function-c/": []
+		}
+	}`)()
+
+	rec := httptest.NewRecorder()
+	statusHandler(rec, httptest.NewRequest("GET", "/?mode=exploit&format=json", nil))
+
+	status := &CallResult{}
+	if err := json.Unmarshal(rec.Body.Bytes(), status); err != nil {
+		t.Fatalf("invalid status response %q: %s", rec.Body.String(), err)
+	}
+
+	outcomes := make(map[string]string)
+	for _, c := range NewVerifyReport(StatusModeExploit, status).Calls {
+		outcomes[c.Caller+" -> "+c.Callee] = c.Outcome()
+		if c.Outcome() == OutcomeBlocked {
+			t.Errorf("%s -> %s blocked: %s", c.Caller, c.Callee, c.Error)
+		}
+	}
+
+	for edge, outcome := range map[string]string{
+		"GET function-a:8080/ -> GRPC users.Get function-b:8080": OutcomeAllowed,
+		"GET function-c:8080/ -> GRPC users.Get function-b:8080": OutcomeVuln,
+		"GRPC users.Get function-b:8080 -> GET function-c:8080/": OutcomeVuln,
+	} {
+		if outcomes[edge] != outcome {
+			t.Errorf("%s is %q, expected %q", edge, outcomes[edge], outcome)
+		}
+	}
+}